@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	boshcmd "github.com/cloudfoundry/bosh-cli/cmd"
+	bicrypto "github.com/cloudfoundry/bosh-cli/crypto"
+	bilog "github.com/cloudfoundry/bosh-cli/logger"
+	boshui "github.com/cloudfoundry/bosh-cli/ui"
+	boshcrypto "github.com/cloudfoundry/bosh-utils/crypto"
+	boshlog "github.com/cloudfoundry/bosh-utils/logger"
+	"github.com/pkg/errors"
+)
+
+// bosh runs a bosh command. Its output is captured and included in the
+// returned error, and additionally streamed to stdout if verbose is set. The
+// embedded CLI cannot be interrupted, so once the context is done, bosh still
+// waits for the command to finish before returning the error of the context:
+// an abandoned command could write blobs.yml after it was restored.
+func bosh(ctx context.Context, args []string, verbose bool, digestAlgorithm string) error {
+	level := boshlog.LevelNone
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	logger, _ := bilog.NewSignalableLogger(boshlog.NewLogger(level), c)
+
+	var output bytes.Buffer
+	outWriter, errWriter := io.Writer(&output), io.Writer(&output)
+	if verbose {
+		outWriter = io.MultiWriter(&output, os.Stdout)
+		errWriter = io.MultiWriter(&output, os.Stderr)
+	}
+
+	ui := boshui.NewWrappingConfUI(boshui.NewPaddingUI(boshui.NewWriterUI(outWriter, errWriter, logger)), logger)
+	defer ui.Flush()
+
+	// the digests of added blobs use the algorithm of -digest-algo
+	deps := boshcmd.NewBasicDeps(ui, logger)
+	if digestAlgorithm != "" {
+		algorithm := map[string]boshcrypto.Algorithm{
+			"sha1":   boshcrypto.DigestAlgorithmSHA1,
+			"sha256": boshcrypto.DigestAlgorithmSHA256,
+			"sha512": boshcrypto.DigestAlgorithmSHA512,
+		}[digestAlgorithm]
+		deps.DigestCreationAlgorithms = []boshcrypto.Algorithm{algorithm}
+		deps.DigestCalculator = bicrypto.NewDigestCalculator(deps.FS, deps.DigestCreationAlgorithms)
+	}
+
+	cmdFactory := boshcmd.NewFactory(deps)
+
+	debugf("Running bosh %s", strings.Join(args, " "))
+	start := time.Now()
+	defer func() {
+		debugf("Finished bosh %s in %s", args[0], time.Since(start).Round(time.Millisecond))
+	}()
+
+	cmd, err := cmdFactory.New(args)
+	if err != nil {
+		return errors.Wrapf(err, "building bosh command %q", strings.Join(args, " "))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Execute()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		warnf("waiting for bosh %s to finish before stopping", args[0])
+		<-done
+		return errors.Wrapf(ctx.Err(), "bosh %s", args[0])
+	}
+	if err != nil {
+		ui.Flush()
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return errors.Wrapf(err, "bosh %s: %s", args[0], out)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// boshExec runs a bosh command with the bosh binary instead of the embedded
+// CLI. Its output is handled like the one of bosh.
+func boshExec(ctx context.Context, bin string, args []string, verbose bool) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.WaitDelay = scriptWaitDelay
+	cmd.Stdout, cmd.Stderr = io.Writer(&output), io.Writer(&output)
+	if verbose {
+		cmd.Stdout = io.MultiWriter(&output, os.Stdout)
+		cmd.Stderr = io.MultiWriter(&output, os.Stderr)
+	}
+
+	debugf("Running %s %s", bin, strings.Join(args, " "))
+	start := time.Now()
+	defer func() {
+		debugf("Finished %s %s in %s", bin, args[0], time.Since(start).Round(time.Millisecond))
+	}()
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "bosh %s", args[0])
+	}
+	if err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return errors.Wrapf(err, "bosh %s: %s", args[0], out)
+		}
+		return errors.Wrapf(err, "bosh %s", args[0])
+	}
+
+	return nil
+}
+
+// boshCLI runs the commands of the bosh CLI in the release dir, or of the
+// bosh binary Bin if it is set. With PrintOnly, the commands are printed as
+// shell command lines instead. The embedded bosh CLI adds blobs with the
+// Digest algorithm, the bosh binary with its default one.
+type boshCLI struct {
+	ReleaseDir    string
+	ConfigDir     string
+	Bin           string
+	Verbose       bool
+	PrintOnly     bool
+	Digest        string
+	PrivateConfig string
+}
+
+func (b boshCLI) run(ctx context.Context, args ...string) error {
+	if b.PrintOnly {
+		bin := b.Bin
+		if bin == "" {
+			bin = "bosh"
+		}
+		printCommand(append([]string{bin}, args...))
+		return nil
+	}
+
+	if b.Bin != "" {
+		return boshExec(ctx, b.Bin, args, b.Verbose)
+	}
+	return bosh(ctx, args, b.Verbose, b.Digest)
+}
+
+func (b boshCLI) AddBlob(ctx context.Context, filePath, blobPath string) error {
+	return b.withReleaseDir(func(dir string) error {
+		return b.run(ctx, "add-blob", fmt.Sprintf("--dir=%s", dir), filePath, blobPath)
+	})
+}
+
+func (b boshCLI) RemoveBlob(ctx context.Context, blobPath string) error {
+	return b.withReleaseDir(func(dir string) error {
+		return b.run(ctx, "remove-blob", fmt.Sprintf("--dir=%s", dir), blobPath)
+	})
+}
+
+func (b boshCLI) UploadBlobs(ctx context.Context) error {
+	if b.PrintOnly {
+		return b.run(ctx, "upload-blobs", fmt.Sprintf("--dir=%s", b.ReleaseDir))
+	}
+	return b.withReleaseDir(func(dir string) error {
+		return b.withPrivateConfig(func() error {
+			return b.run(ctx, "upload-blobs", fmt.Sprintf("--dir=%s", dir))
+		})
+	})
+}
+
+// sameConfigDir returns whether the config directory is 'config' of the
+// release, which bosh uses, or a link to it.
+func sameConfigDir(releaseDir, configDir string) (bool, error) {
+	boshConfigDir := filepath.Join(releaseDir, "config")
+	if configDir == "" || filepath.Clean(configDir) == filepath.Clean(boshConfigDir) {
+		return true, nil
+	}
+
+	info, err := os.Stat(configDir)
+	if err != nil {
+		return false, err
+	}
+	boshInfo, err := os.Stat(boshConfigDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(info, boshInfo), nil
+}
+
+// withReleaseDir runs fn with the release directory to pass to bosh. bosh
+// always uses 'config' of the release directory, so for another ConfigDir, fn
+// runs with a temporary release directory linking 'config' to the ConfigDir
+// and 'blobs' to the blobs of the release.
+func (b boshCLI) withReleaseDir(fn func(dir string) error) error {
+	if b.PrintOnly {
+		return fn(b.ReleaseDir)
+	}
+	same, err := sameConfigDir(b.ReleaseDir, b.ConfigDir)
+	if err != nil {
+		return errors.Wrap(err, "checking config directory")
+	}
+	if same {
+		return fn(b.ReleaseDir)
+	}
+
+	configDir, err := filepath.Abs(b.configDir())
+	if err != nil {
+		return err
+	}
+	blobsDir, err := filepath.Abs(filepath.Join(b.ReleaseDir, "blobs"))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(blobsDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "creating blobs directory")
+	}
+
+	dir, err := ioutil.TempDir("", "bosh-release")
+	if err != nil {
+		return errors.Wrap(err, "creating release directory for the config directory")
+	}
+	defer os.RemoveAll(dir)
+
+	for name, target := range map[string]string{"config": configDir, "blobs": blobsDir} {
+		err = os.Symlink(target, filepath.Join(dir, name))
+		if err != nil {
+			return errors.Wrap(err, "creating release directory for the config directory")
+		}
+	}
+
+	return fn(dir)
+}
+
+// configDir returns the config directory used by the bosh commands.
+func (b boshCLI) configDir() string {
+	if b.ConfigDir == "" {
+		return filepath.Join(b.ReleaseDir, "config")
+	}
+	return b.ConfigDir
+}
+
+// withPrivateConfig provides the PrivateConfig as private.yml of the config
+// directory while fn runs, since bosh has no option for its path. An existing
+// private.yml is never replaced.
+func (b boshCLI) withPrivateConfig(fn func() error) error {
+	if b.PrivateConfig == "" {
+		return fn()
+	}
+
+	target := filepath.Join(b.configDir(), "private.yml")
+	targetInfo, err := os.Stat(target)
+	if err == nil {
+		info, err := os.Stat(b.PrivateConfig)
+		if err == nil && os.SameFile(info, targetInfo) {
+			return fn()
+		}
+		return fmt.Errorf("'%s' exists and would be used by bosh instead of the private config '%s'", target, b.PrivateConfig)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(b.PrivateConfig)
+	if err != nil {
+		return errors.Wrap(err, "reading private config")
+	}
+	err = ioutil.WriteFile(target, data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "providing private config")
+	}
+	defer os.Remove(target)
+
+	return fn()
+}
+
+// safeShellWord matches words which need no quoting in a shell.
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_./=:@%+,-]+$`)
+
+// shellQuote quotes the word for a POSIX shell if necessary.
+func shellQuote(word string) string {
+	if safeShellWord.MatchString(word) {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// printCommand prints the command as a line which can be pasted into a
+// shell. It is printed regardless of the log level.
+func printCommand(args []string) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	fmt.Fprintln(logOutput, strings.Join(quoted, " "))
+}
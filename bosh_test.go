@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBoshCLIConfigDir(t *testing.T) {
+	releaseDir := filepath.Join(t.TempDir(), "release")
+	configDir := filepath.Join(t.TempDir(), "other-config")
+	for _, dir := range []string{filepath.Join(releaseDir, "config"), configDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "blobs.yml"), []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filePath := filepath.Join(t.TempDir(), "foo-1.1.0.tgz")
+	if err := ioutil.WriteFile(filePath, []byte("foo 1.1.0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := boshCLI{ReleaseDir: releaseDir, ConfigDir: configDir, Digest: "sha256"}
+	if err := b.AddBlob(context.Background(), filePath, "foo/foo-1.1.0.tgz"); err != nil {
+		t.Fatalf("AddBlob: %v", err)
+	}
+
+	blobs, err := readBlobs(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blobs["foo/foo-1.1.0.tgz"]; !ok {
+		t.Errorf("blobs.yml of the config directory = %v, want the added blob", blobs)
+	}
+	blobs, err = readBlobs(filepath.Join(releaseDir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("blobs.yml of the release = %v, want it unchanged", blobs)
+	}
+	if _, err := os.Stat(filepath.Join(releaseDir, "blobs", "foo", "foo-1.1.0.tgz")); err != nil {
+		t.Errorf("added blob is not in the blobs of the release: %v", err)
+	}
+}
+
+func TestCheckConfigDir(t *testing.T) {
+	releaseDir := t.TempDir()
+	otherDir := filepath.Join(t.TempDir(), "other-config")
+	for _, dir := range []string{filepath.Join(releaseDir, "config"), otherDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linkedRelease := t.TempDir()
+	if err := os.Symlink(otherDir, filepath.Join(linkedRelease, "config")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		releaseDir string
+		configDir  string
+		wantErr    string
+	}{
+		{name: "default config directory", releaseDir: releaseDir, configDir: "config"},
+		{name: "absolute config directory of the release", releaseDir: releaseDir, configDir: filepath.Join(releaseDir, "config")},
+		{name: "config linked to the config directory", releaseDir: linkedRelease, configDir: otherDir},
+		{name: "other config directory", releaseDir: releaseDir, configDir: otherDir, wantErr: "-print-commands requires -config-dir"},
+		{name: "missing config directory", releaseDir: releaseDir, configDir: "missing", wantErr: "checking config directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Upgrader{ReleaseDir: tt.releaseDir, Options: options{ConfigDir: tt.configDir, PrintCommands: true}}
+			err := u.checkConfigDir()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// versionCache stores the output of version_check scripts on disk. It is
+// disabled if TTL is zero.
+type versionCache struct {
+	Dir     string
+	TTL     time.Duration
+	Refresh bool
+	Clock   clock
+}
+
+// newVersionCache returns the version cache configured by the options. The
+// cache lives in the user cache directory.
+func newVersionCache(opts options, clock clock) versionCache {
+	cache := versionCache{TTL: opts.VersionCacheTTL, Refresh: opts.NoCache, Clock: clock}
+	if cache.TTL <= 0 {
+		return cache
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		warnf("disabling version cache: %v", err)
+		cache.TTL = 0
+		return cache
+	}
+	cache.Dir = filepath.Join(dir, "bosh-blobs-upgrader", "versions")
+
+	return cache
+}
+
+// path returns the cache file of the script of the package. Changing the
+// script invalidates its cached output. The package name is escaped, so that
+// nested packages like golang/go do not refer to subdirectories.
+func (c versionCache) path(packageName, script string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%s-%x", url.PathEscape(packageName), sha256.Sum256([]byte(script))))
+}
+
+// Get returns the cached output of the version_check script of the package if
+// there is a fresh cache entry.
+func (c versionCache) Get(packageName, script string) ([]byte, bool) {
+	if c.TTL <= 0 || c.Refresh {
+		return nil, false
+	}
+
+	cachePath := c.path(packageName, script)
+	info, err := os.Stat(cachePath)
+	if err != nil || c.Clock.Now().Sub(info.ModTime()) >= c.TTL {
+		return nil, false
+	}
+
+	stdout, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, false
+	}
+
+	infof("Using cached versions of package '%s'.", packageName)
+	return stdout, true
+}
+
+// Put caches the output of the version_check script of the package. A broken
+// cache must not fail the upgrade, so errors are only printed.
+func (c versionCache) Put(packageName, script string, stdout []byte) {
+	if c.TTL <= 0 {
+		return
+	}
+
+	err := c.write(c.path(packageName, script), stdout)
+	if err != nil {
+		warnf("caching versions of package '%s': %v", packageName, err)
+	}
+}
+
+func (c versionCache) write(cachePath string, stdout []byte) error {
+	err := os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "creating cache directory")
+	}
+	return ioutil.WriteFile(cachePath, stdout, 0644)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ANSI escape sequences of the colors used in the output.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// colorMode selects whether the output is colorized. It is a flag.Value.
+type colorMode int
+
+// Color modes.
+const (
+	colorAuto colorMode = iota
+	colorAlways
+	colorNever
+)
+
+var colorModeNames = []string{"auto", "always", "never"}
+
+func (m *colorMode) String() string {
+	if *m < colorAuto || *m > colorNever {
+		return "unknown"
+	}
+	return colorModeNames[*m]
+}
+
+func (m *colorMode) Set(value string) error {
+	for i, name := range colorModeNames {
+		if strings.EqualFold(value, name) {
+			*m = colorMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid color mode '%s' (expected one of %s)", value, strings.Join(colorModeNames, ", "))
+}
+
+// enabled reports whether output to the file is colorized. In auto mode,
+// only terminals get colors unless NO_COLOR is set.
+func (m colorMode) enabled(f *os.File) bool {
+	switch m {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// colorEnabled is set from the -color flag and applies to all output.
+var colorEnabled bool
+
+// colorize wraps the text in the color if colors are enabled.
+func colorize(color, s string) string {
+	if !colorEnabled || color == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// actionColor returns the color of a package action: green for unchanged
+// packages, yellow for changes and red for failures.
+func actionColor(action string) string {
+	switch action {
+	case actionUnchanged, actionPinned:
+		return colorGreen
+	case actionUpgraded, actionOutdated:
+		return colorYellow
+	case actionFailed:
+		return colorRed
+	}
+	return ""
+}
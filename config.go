@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// configFileName is the name of the optional config file in the release dir.
+const configFileName = ".blobs-upgrader.yml"
+
+// envFlags maps flags to the environment variables overriding the config file.
+var envFlags = map[string]string{
+	"bosh-bin":       "BLOBS_UPGRADER_BOSH_BIN",
+	"debug":          "BLOBS_UPGRADER_DEBUG",
+	"git-author":     "BLOBS_UPGRADER_GIT_AUTHOR",
+	"github-base":    "BLOBS_UPGRADER_GITHUB_BASE",
+	"http-timeout":   "BLOBS_UPGRADER_HTTP_TIMEOUT",
+	"log-level":      "BLOBS_UPGRADER_LOG_LEVEL",
+	"notify-url":     "BLOBS_UPGRADER_NOTIFY_URL",
+	"private-config": "BLOBS_UPGRADER_PRIVATE_CONFIG",
+	"tls-ca":         "BLOBS_UPGRADER_TLS_CA",
+	"tls-cert":       "BLOBS_UPGRADER_TLS_CERT",
+	"tls-key":        "BLOBS_UPGRADER_TLS_KEY",
+	"tmp-dir":        "BLOBS_UPGRADER_TMP_DIR",
+	"user-agent":     "BLOBS_UPGRADER_USER_AGENT",
+}
+
+// nonConfigFlags are the flags which cannot be set in the config file.
+var nonConfigFlags = map[string]bool{
+	"config":  true,
+	"dir":     true,
+	"help":    true,
+	"version": true,
+}
+
+// configValue is a scalar or a list of scalars, which is joined by commas.
+type configValue string
+
+func (v *configValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*v = configValue(strings.Join(list, ","))
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*v = configValue(value)
+	return nil
+}
+
+// loadConfigFile sets the flags of the flag set from the options in the config
+// file. Flags given on the command line or via their environment variable take
+// precedence. A missing file is only an error if required is set.
+func loadConfigFile(fs *flag.FlagSet, path string, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading config file")
+	}
+
+	values := map[string]configValue{}
+	err = yaml.UnmarshalStrict(data, &values)
+	if err != nil {
+		return errors.Wrapf(err, "decoding config file '%s'", path)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if nonConfigFlags[name] || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option '%s' in config file '%s'", name, path)
+		}
+		if set[name] {
+			continue
+		}
+		if _, ok := os.LookupEnv(envFlags[name]); ok && envFlags[name] != "" {
+			continue
+		}
+
+		err = fs.Set(name, string(values[name]))
+		if err != nil {
+			return errors.Wrapf(err, "setting option '%s' from config file '%s'", name, path)
+		}
+	}
+
+	return nil
+}
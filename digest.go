@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/dpb587/metalink"
+)
+
+// digestAlgorithms are the algorithms of blob digests from the weakest to the
+// strongest. Each download is hashed with all of them, so that it can be
+// compared with blobs whose digest uses any of them.
+var digestAlgorithms = []string{"sha1", "sha256", "sha512"}
+
+// newDigestHash returns the hash of the digest algorithm.
+func newDigestHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// newDigestHashes returns a hash of each digest algorithm and the writers
+// feeding all of them.
+func newDigestHashes() (map[string]hash.Hash, []io.Writer) {
+	hashes := map[string]hash.Hash{}
+	var writers []io.Writer
+	for _, algorithm := range digestAlgorithms {
+		hashes[algorithm] = newDigestHash(algorithm)
+		writers = append(writers, hashes[algorithm])
+	}
+	return hashes, writers
+}
+
+// sumDigests returns the hex sums of the hashes by algorithm.
+func sumDigests(hashes map[string]hash.Hash) map[string]string {
+	sums := map[string]string{}
+	for algorithm, h := range hashes {
+		sums[algorithm] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums
+}
+
+// metalinkAlgorithm returns the digest algorithm of a metalink hash type,
+// or an empty string if it is not supported, e.g. for md5.
+func metalinkAlgorithm(hashType metalink.HashType) string {
+	switch metalink.HashType(strings.ToLower(strings.TrimSpace(string(hashType)))) {
+	case metalink.HashTypeSHA1:
+		return "sha1"
+	case metalink.HashTypeSHA256:
+		return "sha256"
+	case metalink.HashTypeSHA512:
+		return "sha512"
+	}
+	return ""
+}
+
+// hashStrength ranks the metalink hash type by the order of
+// digestAlgorithms. Unsupported types rank lowest with 0.
+func hashStrength(hashType metalink.HashType) int {
+	algorithm := metalinkAlgorithm(hashType)
+	for i, a := range digestAlgorithms {
+		if a == algorithm {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// strongestHash returns the strongest supported hash published in the
+// metalink, which verifies the download.
+func strongestHash(hashes []metalink.Hash) (metalink.Hash, bool) {
+	var strongest metalink.Hash
+	for _, h := range hashes {
+		if hashStrength(h.Type) > hashStrength(strongest.Type) {
+			strongest = h
+		}
+	}
+	return strongest, hashStrength(strongest.Type) > 0
+}
+
+// digestAlgorithm selects the algorithm of the digests of new blobs. It is a
+// flag.Value.
+type digestAlgorithm string
+
+func (a *digestAlgorithm) String() string {
+	return string(*a)
+}
+
+func (a *digestAlgorithm) Set(value string) error {
+	for _, algorithm := range digestAlgorithms {
+		if strings.EqualFold(value, algorithm) {
+			*a = digestAlgorithm(algorithm)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid digest algorithm '%s' (expected one of %s)", value, strings.Join(digestAlgorithms, ", "))
+}
+
+// formatDigest returns the digest in the format of blobs.yml, where sha1
+// digests have no prefix.
+func formatDigest(algorithm, sum string) string {
+	if algorithm == "sha1" {
+		return sum
+	}
+	return fmt.Sprintf("%s:%s", algorithm, sum)
+}
+
+// parseDigest returns the sums of a digest of blobs.yml by algorithm. The
+// digest may list several algorithms separated by ';'.
+func parseDigest(digest string) map[string]string {
+	sums := map[string]string{}
+	for _, part := range strings.Split(digest, ";") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		parts := strings.SplitN(part, ":", 2)
+		if len(parts) == 1 {
+			sums["sha1"] = parts[0]
+			continue
+		}
+		sums[parts[0]] = parts[1]
+	}
+	return sums
+}
+
+// compareDigests compares the sums of the strongest algorithm both digests
+// have in common. It reports whether they could be compared at all.
+func compareDigests(a, b map[string]string) (equal bool, comparable bool) {
+	for i := len(digestAlgorithms) - 1; i >= 0; i-- {
+		algorithm := digestAlgorithms[i]
+		sumA, okA := a[algorithm]
+		sumB, okB := b[algorithm]
+		if okA && okB {
+			return sumA == sumB, true
+		}
+	}
+	return false, false
+}
+
+// hasDigest reports whether the downloaded blob has the digest of
+// blobs.yml, whatever its algorithm.
+func (b Blob) hasDigest(digest string) bool {
+	equal, _ := compareDigests(b.digests, parseDigest(digest))
+	return equal
+}
+
+// metalinkDigests returns the sums of the hashes published in the metalink
+// by algorithm.
+func metalinkDigests(hashes []metalink.Hash) map[string]string {
+	sums := map[string]string{}
+	for _, h := range hashes {
+		if algorithm := metalinkAlgorithm(h.Type); algorithm != "" {
+			sums[algorithm] = strings.ToLower(strings.TrimSpace(h.Hash))
+		}
+	}
+	return sums
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE of renaming a file to another
+// drive.
+const errorNotSameDevice = syscall.Errno(17)
+
+// freeSpace does not determine the free space on Windows, so that the disk
+// space check is skipped.
+func freeSpace(dir string) (uint64, bool) {
+	return 0, false
+}
+
+// isCrossDevice reports whether renaming failed because the paths are on
+// different drives.
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == errorNotSameDevice
+}
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpb587/metalink"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// dialTimeout is the timeout for establishing connections to mirrors.
+const dialTimeout = 30 * time.Second
+
+// Limits of the connections of the shared download transport. Connections to
+// the same mirror are reused and bounded.
+const (
+	maxIdleConns        = 16
+	maxIdleConnsPerHost = 4
+	maxConnsPerHost     = 8
+	idleConnTimeout     = 90 * time.Second
+)
+
+// retryBackoff is the delay before the first retry of a failed download. It
+// doubles with every further attempt up to maxRetryBackoff.
+const (
+	retryBackoff    = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// errorBodyLimit is the number of bytes of an unsuccessful response body
+// included in download errors.
+const errorBodyLimit = 512
+
+// hashFile writes the content of the file to the hash.
+func hashFile(path string, h io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// newHTTPClient returns the client shared by all downloads of a run. The
+// timeout covers the whole request including reading the response body.
+func newHTTPClient(opts options) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = newTransport(opts, tlsConfig)
+	if len(opts.InsecureHosts) > 0 {
+		insecureConfig := &tls.Config{}
+		if tlsConfig != nil {
+			insecureConfig = tlsConfig.Clone()
+		}
+		insecureConfig.InsecureSkipVerify = true
+		hosts := map[string]bool{}
+		for _, host := range opts.InsecureHosts {
+			hosts[strings.ToLower(host)] = true
+		}
+		transport = hostTransport{
+			Hosts:    hosts,
+			Insecure: newTransport(opts, insecureConfig),
+			Default:  transport,
+		}
+	}
+
+	return &http.Client{
+		Timeout:       opts.HTTPTimeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect(opts.MaxRedirects),
+	}, nil
+}
+
+// errTooManyRedirects is returned by the client if a request was redirected
+// more often than allowed, e.g. in a redirect loop.
+var errTooManyRedirects = errors.New("too many redirects")
+
+// checkRedirect returns the redirect policy of the client, which logs each
+// hop and stops after the maximum number of redirects.
+func checkRedirect(maxRedirects int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return errors.Wrapf(errTooManyRedirects, "stopped after %d redirects", maxRedirects)
+		}
+		debugf("Redirected from %s to %s", via[len(via)-1].URL, req.URL)
+		return nil
+	}
+}
+
+// newTransport returns the transport of the client with the TLS config.
+func newTransport(opts options, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: proxyFunc(opts.Proxy, opts.NoProxy),
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		MaxConnsPerHost:     maxConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+}
+
+// hostTransport sends requests to the Hosts with the Insecure transport,
+// which does not verify TLS certificates, and all others with the Default
+// transport. Redirects are routed by their target host.
+type hostTransport struct {
+	Hosts    map[string]bool
+	Insecure http.RoundTripper
+	Default  http.RoundTripper
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Hosts[strings.ToLower(req.URL.Hostname())] {
+		return t.Insecure.RoundTrip(req)
+	}
+	return t.Default.RoundTrip(req)
+}
+
+// newTLSConfig returns the TLS config presenting the client certificate and
+// trusting the CA in addition to the system roots. Certificates are not
+// verified with -insecure unless it is limited to -insecure-hosts. It is nil
+// if none of the options is given.
+func newTLSConfig(opts options) (*tls.Config, error) {
+	certFile, keyFile, caFile := opts.TLSCert, opts.TLSKey, opts.TLSCA
+	if certFile == "" && keyFile == "" && caFile == "" && !opts.Insecure {
+		return nil, nil
+	}
+	config := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading CA certificate")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	// -insecure-hosts limits -insecure to a separate transport
+	config.InsecureSkipVerify = opts.Insecure && len(opts.InsecureHosts) == 0
+
+	return config, nil
+}
+
+// proxyFunc returns the proxy selection of the download transport. The proxy
+// settings of the environment are overridden by non-empty arguments.
+func proxyFunc(proxy, noProxy string) func(*http.Request) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	if proxy != "" {
+		config.HTTPProxy = proxy
+		config.HTTPSProxy = proxy
+	}
+	if noProxy != "" {
+		config.NoProxy = noProxy
+	}
+
+	proxyURL := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyURL(req.URL)
+	}
+}
+
+// temporaryError marks download failures which are worth retrying, like
+// network errors and server side failures.
+type temporaryError struct {
+	error
+}
+
+func isTemporary(err error) bool {
+	_, ok := err.(temporaryError)
+	return ok
+}
+
+// hostEnvSuffix returns the suffix of environment variables holding host
+// specific credentials, e.g. "ARTIFACTS_EXAMPLE_COM" for artifacts.example.com.
+func hostEnvSuffix(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// setCredentials authenticates the request with credentials from the
+// environment. Host specific credentials take precedence over global ones and
+// a bearer token takes precedence over basic auth.
+func setCredentials(req *http.Request) {
+	for _, suffix := range []string{"_" + hostEnvSuffix(req.URL.Hostname()), ""} {
+		if token, ok := os.LookupEnv("BLOBS_UPGRADER_HTTP_TOKEN" + suffix); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return
+		}
+		if username, ok := os.LookupEnv("BLOBS_UPGRADER_HTTP_USERNAME" + suffix); ok {
+			req.SetBasicAuth(username, getFromEnv("BLOBS_UPGRADER_HTTP_PASSWORD"+suffix, ""))
+			return
+		}
+	}
+}
+
+// sortURLs orders the metalink URLs by priority. URLs without a priority
+// come last and keep their original order.
+func sortURLs(urls []metalink.URL) []metalink.URL {
+	sorted := make([]metalink.URL, len(urls))
+	copy(sorted, urls)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[j].Priority == nil {
+			return sorted[i].Priority != nil
+		}
+		if sorted[i].Priority == nil {
+			return false
+		}
+		return *sorted[i].Priority < *sorted[j].Priority
+	})
+	return sorted
+}
+
+// mirrorURL returns the url on the mirror of its host, keeping the path and
+// query.
+func mirrorURL(rawURL string, mirrors map[string]string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	base, ok := mirrors[strings.ToLower(u.Hostname())]
+	if !ok {
+		return "", false
+	}
+
+	mirrored := base + u.EscapedPath()
+	if u.RawQuery != "" {
+		mirrored += "?" + u.RawQuery
+	}
+	return mirrored, true
+}
+
+// urlHandler opens the URLs of a scheme for reading. Failures worth retrying
+// are returned as temporaryError.
+type urlHandler interface {
+	Open(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// httpHandler opens http and https URLs with credentials from the
+// environment.
+type httpHandler struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+func (h httpHandler) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	body, _, err := h.OpenAt(ctx, url, 0)
+	return body, err
+}
+
+// OpenAt requests the url from the offset with a Range header and reports
+// whether the server honored it. Servers ignoring the range return the whole
+// file.
+func (h httpHandler) OpenAt(ctx context.Context, rawURL string, offset int64) (io.ReadCloser, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	setCredentials(req)
+	req.Header.Set("User-Agent", h.UserAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && errors.Cause(uerr.Err) == errTooManyRedirects {
+			return nil, false, err
+		}
+		return nil, false, temporaryError{err}
+	}
+
+	// the partial file does not fit the remote file anymore
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return h.OpenAt(ctx, rawURL, 0)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errorBodyLimit))
+		err = fmt.Errorf("unexpected response '%s': %s", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, false, temporaryError{err}
+		}
+		return nil, false, err
+	}
+
+	// mirrors redirecting to login or error pages
+	if resp.Request.URL.String() != rawURL && isHTML(resp.Header.Get("Content-Type")) {
+		resp.Body.Close()
+		return nil, false, fmt.Errorf("redirected to '%s', which returned HTML instead of the file", resp.Request.URL)
+	}
+
+	body := httpBody{ReadCloser: resp.Body, contentType: resp.Header.Get("Content-Type")}
+	return body, offset > 0 && resp.StatusCode == http.StatusPartialContent, nil
+}
+
+// httpBody is a response body which knows its Content-Type.
+type httpBody struct {
+	io.ReadCloser
+	contentType string
+}
+
+func (b httpBody) ContentType() string {
+	return b.contentType
+}
+
+// contentTyper is implemented by bodies of URL handlers which know the
+// content type of the response.
+type contentTyper interface {
+	ContentType() string
+}
+
+// checkContent fails if the content type or the first bytes of a download
+// reveal an HTML page, e.g. an error or login page served with status 200,
+// instead of a binary artifact.
+func checkContent(contentType string, head []byte) error {
+	if isHTML(contentType) {
+		return fmt.Errorf("verifying download: got an HTML page (Content-Type '%s') instead of the file", contentType)
+	}
+
+	if len(head) > 0 && isHTML(http.DetectContentType(head)) {
+		snippet := strings.Join(strings.Fields(string(head)), " ")
+		if len(snippet) > 80 {
+			snippet = snippet[:80] + "..."
+		}
+		return fmt.Errorf("verifying download: content looks like an HTML page instead of the file: %s", snippet)
+	}
+
+	return nil
+}
+
+// isHTML reports whether the content type is an HTML page.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// Stat returns the validators of the url from a HEAD request.
+func (h httpHandler) Stat(ctx context.Context, url string) (remoteValidators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return remoteValidators{}, err
+	}
+	setCredentials(req)
+	req.Header.Set("User-Agent", h.UserAgent)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return remoteValidators{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return remoteValidators{}, fmt.Errorf("unexpected response '%s'", resp.Status)
+	}
+
+	v := remoteValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.ContentLength > 0 {
+		v.ContentLength = resp.ContentLength
+	}
+
+	return v, nil
+}
+
+// rangeOpener is implemented by URL handlers which can resume downloads from
+// an offset.
+type rangeOpener interface {
+	OpenAt(ctx context.Context, url string, offset int64) (io.ReadCloser, bool, error)
+}
+
+// urlStater is implemented by URL handlers which can return the validators
+// of a URL without downloading it.
+type urlStater interface {
+	Stat(ctx context.Context, url string) (remoteValidators, error)
+}
+
+// schemeDownloader downloads metalink files with the handler registered for
+// the scheme of each URL.
+type schemeDownloader struct {
+	Handlers     map[string]urlHandler
+	Retries      int
+	FileMode     os.FileMode
+	Progress     bool
+	Limiter      *rateLimiter
+	Mirrors      map[string]string
+	MaxSize      int64
+	CheckContent bool
+	Digest       string
+	TmpDir       string
+}
+
+// newDownloader returns a downloader handling http and https URLs.
+func newDownloader(opts options) (*schemeDownloader, error) {
+	d := &schemeDownloader{
+		Handlers:     map[string]urlHandler{},
+		Retries:      opts.Retries,
+		FileMode:     os.FileMode(opts.FileMode),
+		Progress:     opts.Progress,
+		Mirrors:      opts.Mirrors,
+		MaxSize:      int64(opts.MaxSize),
+		CheckContent: !opts.SkipContentCheck,
+		Digest:       string(opts.DigestAlgorithm),
+		TmpDir:       opts.TmpDir,
+	}
+	if opts.RateLimit > 0 {
+		d.Limiter = newRateLimiter(int64(opts.RateLimit))
+	}
+
+	if d.TmpDir != "" {
+		info, err := os.Stat(d.TmpDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "checking temporary directory")
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("temporary directory '%s' is not a directory", d.TmpDir)
+		}
+	}
+
+	client, err := newHTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := httpHandler{Client: client, UserAgent: opts.UserAgent}
+	d.Register("http", handler)
+	d.Register("https", handler)
+
+	return d, nil
+}
+
+// Register sets the handler of URLs with the scheme.
+func (d *schemeDownloader) Register(scheme string, handler urlHandler) {
+	d.Handlers[strings.ToLower(scheme)] = handler
+}
+
+// handler returns the handler of the scheme of the url.
+func (d *schemeDownloader) handler(rawURL string) (urlHandler, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, ok := d.Handlers[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported URL scheme '%s'", u.Scheme)
+	}
+
+	return handler, nil
+}
+
+// open opens the url with the handler of its scheme.
+func (d *schemeDownloader) open(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	handler, err := d.handler(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler.Open(ctx, rawURL)
+}
+
+// openAt opens the url from the offset if its handler supports resuming, and
+// reports whether it did. Otherwise the url is opened from the beginning.
+func (d *schemeDownloader) openAt(ctx context.Context, rawURL string, offset int64) (io.ReadCloser, bool, error) {
+	handler, err := d.handler(rawURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if r, ok := handler.(rangeOpener); ok && offset > 0 {
+		return r.OpenAt(ctx, rawURL, offset)
+	}
+
+	body, err := handler.Open(ctx, rawURL)
+	return body, false, err
+}
+
+// urls returns the URLs of the file by priority. URLs of hosts with a
+// configured mirror are tried on the mirror first, the original URLs are kept
+// as fallback.
+func (d *schemeDownloader) urls(file metalink.File) []metalink.URL {
+	sorted := sortURLs(file.URLs)
+	if len(d.Mirrors) == 0 {
+		return sorted
+	}
+
+	var mirrored []metalink.URL
+	for _, u := range sorted {
+		if rewritten, ok := mirrorURL(u.URL, d.Mirrors); ok {
+			mirrored = append(mirrored, metalink.URL{URL: rewritten})
+		}
+	}
+
+	return append(mirrored, sorted...)
+}
+
+// Stat returns the validators of the preferred mirror of the metalink file.
+func (d *schemeDownloader) Stat(ctx context.Context, file metalink.File) (remoteValidators, error) {
+	if len(file.URLs) == 0 {
+		return remoteValidators{}, errors.New("no download URLs")
+	}
+	rawURL := d.urls(file)[0].URL
+
+	handler, err := d.handler(rawURL)
+	if err != nil {
+		return remoteValidators{}, err
+	}
+
+	stater, ok := handler.(urlStater)
+	if !ok {
+		return remoteValidators{}, fmt.Errorf("no validators available for '%s'", rawURL)
+	}
+
+	return stater.Stat(ctx, rawURL)
+}
+
+// Get returns the content of a small file like a metalink. Temporary
+// failures are retried like downloads.
+func (d *schemeDownloader) Get(ctx context.Context, url string) ([]byte, error) {
+	var data []byte
+	err := d.withRetries(ctx, url, func() error {
+		body, err := d.open(ctx, url)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		data, err = ioutil.ReadAll(body)
+		if err != nil {
+			return temporaryError{fmt.Errorf("reading response: %v", err)}
+		}
+		return nil
+	})
+	return data, err
+}
+
+// Download will download the metalink file from the first working mirror
+// to a local file, verify it against the metalink hashes and return the
+// number of transferred bytes. Interrupted downloads are resumed by later
+// attempts, also from other mirrors.
+func (d *schemeDownloader) Download(ctx context.Context, filePath string, file metalink.File) (Blob, int64, error) {
+	if len(file.URLs) == 0 {
+		return Blob{}, 0, errors.New("no download URLs")
+	}
+
+	// do not leave partial downloads behind in the release
+	defer os.Remove(d.partialPath(filePath))
+
+	var (
+		failures []string
+		total    int64
+	)
+	sorted := d.urls(file)
+	for i, url := range sorted {
+		debugf("Trying mirror %d of %d for %s: %s", i+1, len(sorted), filePath, url.URL)
+		start := time.Now()
+		blob, n, err := d.downloadWithRetries(ctx, filePath, url.URL, file)
+		total += n
+		if ctx.Err() != nil {
+			return Blob{}, total, ctx.Err()
+		}
+		if err != nil {
+			warnf("mirror %s failed: %v", url.URL, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", url.URL, err))
+			continue
+		}
+
+		infof("Downloaded %s from %s", filePath, url.URL)
+		debugf("Downloaded %s in %s", formatBytes(n), time.Since(start).Round(time.Millisecond))
+		return blob, total, nil
+	}
+
+	return Blob{}, total, fmt.Errorf("all mirrors failed: %s", strings.Join(failures, "; "))
+}
+
+// downloadWithRetries retries temporary failures of downloading the url with
+// an exponential backoff.
+func (d *schemeDownloader) downloadWithRetries(ctx context.Context, filePath, url string, file metalink.File) (Blob, int64, error) {
+	var (
+		blob  Blob
+		total int64
+	)
+	err := d.withRetries(ctx, url, func() error {
+		var (
+			n   int64
+			err error
+		)
+		blob, n, err = d.downloadURL(ctx, filePath, url, file)
+		total += n
+		return err
+	})
+	return blob, total, err
+}
+
+// withRetries retries temporary failures of the request of the url with an
+// exponential backoff, up to the configured number of retries.
+func (d *schemeDownloader) withRetries(ctx context.Context, url string, request func() error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if err == nil || !isTemporary(err) || attempt >= d.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		warnf("retrying download of %s in %s: %v", url, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// partialPath returns the path of the partial download of the file, which is
+// next to it unless there is a TmpDir. Partial downloads in the TmpDir are
+// named after a hash of the path, so that files of the same name in other
+// packages or releases do not collide.
+func (d *schemeDownloader) partialPath(filePath string) string {
+	if d.TmpDir == "" {
+		return filepath.Join(filepath.Dir(filePath), fmt.Sprintf(".%s.part", filepath.Base(filePath)))
+	}
+
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		absPath = filePath
+	}
+	sum := sha256.Sum256([]byte(absPath))
+	return filepath.Join(d.TmpDir, fmt.Sprintf("bosh-blobs-upgrader-%x-%s.part", sum[:6], filepath.Base(filePath)))
+}
+
+// moveFile renames the file into place. A file on another file system, e.g.
+// in the -tmp-dir, is copied next to the destination first, so that the
+// destination is still replaced atomically.
+func moveFile(src, dst string, perm os.FileMode) error {
+	err := os.Rename(src, dst)
+	if !isCrossDevice(err) {
+		return err
+	}
+	debugf("Copying %s to %s across file systems", src, dst)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), fmt.Sprintf(".%s.", filepath.Base(dst)))
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// downloadURL will download a url to a local file and verify it against the
+// hashes of the metalink file. A partial download of a previous attempt is
+// resumed if the file has a digest to verify the result.
+func (d *schemeDownloader) downloadURL(ctx context.Context, filePath, url string, file metalink.File) (Blob, int64, error) {
+	var blob Blob
+	expected, verify := strongestHash(file.Hashes)
+
+	// download to a partial file, which is only moved into place once it is
+	// complete and verified. It is kept for the next attempt if the transfer
+	// was interrupted.
+	partPath := d.partialPath(filePath)
+	keepPart := false
+	defer func() {
+		if !keepPart {
+			os.Remove(partPath)
+		}
+	}()
+
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && verify {
+		offset = info.Size()
+	}
+
+	if offset > 0 {
+		infof("Resuming download of %s from %s at %s", filePath, url, formatBytes(offset))
+	} else {
+		infof("Downloading %s from %s", filePath, url)
+	}
+
+	body, resumed, err := d.openAt(ctx, url, offset)
+	if err != nil {
+		keepPart = offset > 0
+		return blob, 0, err
+	}
+	defer body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resumed {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	} else if offset > 0 {
+		debugf("Range of %s was ignored, restarting the download", url)
+		offset = 0
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		return blob, 0, err
+	}
+	defer out.Close()
+
+	// hash while writing to avoid reading the file again, with all
+	// algorithms so that the blob can be compared with any existing digest
+	hashes, hashers := newDigestHashes()
+
+	// the bytes of the previous attempt are only hashed once
+	if offset > 0 {
+		err = hashFile(partPath, io.MultiWriter(hashers...))
+		if err != nil {
+			return blob, 0, fmt.Errorf("hashing partial download: %v", err)
+		}
+	}
+	writers := append([]io.Writer{out}, hashers...)
+
+	var reader io.Reader = body
+	// a resumed download does not start with the header of the file, and
+	// HTML files are expected to be HTML
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	if d.CheckContent && offset == 0 && ext != ".html" && ext != ".htm" {
+		var contentType string
+		if typed, ok := body.(contentTyper); ok {
+			contentType = typed.ContentType()
+		}
+		buffered := bufio.NewReader(body)
+		head, _ := buffered.Peek(512)
+		err = checkContent(contentType, head)
+		if err != nil {
+			return blob, 0, err
+		}
+		reader = buffered
+	}
+	if d.MaxSize > 0 {
+		// read one byte more to detect files exceeding the limit
+		reader = io.LimitReader(reader, d.MaxSize-offset+1)
+	}
+	if d.Limiter != nil {
+		reader = &limitedReader{ctx: ctx, reader: reader, limiter: d.Limiter}
+	}
+	if d.Progress {
+		progress := newProgressReader(reader, int64(file.Size)-offset, os.Stdout)
+		defer progress.Finish()
+		reader = progress
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), reader)
+	if err != nil {
+		keepPart = verify
+		return blob, n, temporaryError{fmt.Errorf("writing file: %v", err)}
+	}
+
+	if d.MaxSize > 0 && offset+n > d.MaxSize {
+		return blob, n, fmt.Errorf("download exceeds -max-size %s", formatBytes(d.MaxSize))
+	}
+
+	// a size mismatch is cheaper to detect than a digest mismatch. Like the
+	// latter, it is not retried, unless the body was truncated, which can be
+	// resumed.
+	if file.Size > 0 && uint64(offset+n) != file.Size {
+		err = fmt.Errorf("verifying download: size mismatch: expected %d bytes, got %d", file.Size, offset+n)
+		if uint64(offset+n) < file.Size {
+			keepPart = verify
+			return blob, n, temporaryError{err}
+		}
+		return blob, n, err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return blob, n, fmt.Errorf("closing file: %v", err)
+	}
+
+	err = os.Chmod(partPath, d.FileMode)
+	if err != nil {
+		return blob, n, fmt.Errorf("changing permissions: %v", err)
+	}
+
+	if verify {
+		actual := fmt.Sprintf("%x", hashes[metalinkAlgorithm(expected.Type)].Sum(nil))
+		if actual != strings.ToLower(strings.TrimSpace(expected.Hash)) {
+			return blob, n, fmt.Errorf("verifying download: %s digest mismatch: expected '%s', got '%s'", expected.Type, expected.Hash, actual)
+		}
+	}
+
+	err = moveFile(partPath, filePath, d.FileMode)
+	if err != nil {
+		return blob, n, fmt.Errorf("moving file into place: %v", err)
+	}
+
+	blob.digests = sumDigests(hashes)
+	blob.Sha = formatDigest(d.Digest, blob.digests[d.Digest])
+
+	return blob, n, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dpb587/metalink"
+)
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         uint64
+		wantRequests int32
+	}{
+		{name: "larger file is not retried", size: 4, wantRequests: 1},
+		{name: "truncated file is retried", size: 10, wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Write([]byte("foobar"))
+			}))
+			defer server.Close()
+
+			d, err := newDownloader(options{Retries: 1, FileMode: 0644, DigestAlgorithm: "sha256", MaxRedirects: 10, SkipContentCheck: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := metalink.File{Name: "foo.tgz", Size: tt.size, URLs: []metalink.URL{{URL: server.URL + "/foo.tgz"}}}
+
+			_, _, err = d.Download(context.Background(), filepath.Join(t.TempDir(), "foo.tgz"), file)
+			if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+				t.Fatalf("error = %v, want a size mismatch", err)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -1,3 +1,30 @@
 #!/bin/sh -l
 
-exec /bosh-blobs-upgrader "$1"
\ No newline at end of file
+# the upgrader runs in the background, since sh as PID 1 of the container
+# does not forward signals and the upgrader could not clean up on
+# cancellation
+/bosh-blobs-upgrader "$1" &
+pid=$!
+trap 'kill -TERM "$pid" 2>/dev/null' TERM
+trap 'kill -INT "$pid" 2>/dev/null' INT
+
+# wait returns early when a trapped signal arrives, so it is repeated until
+# the upgrader exited
+wait "$pid"
+code=$?
+while kill -0 "$pid" 2>/dev/null; do
+  wait "$pid"
+  code=$?
+done
+
+# exit code 10 signals upgraded blobs, which is a success for the action
+changed=false
+if [ "$code" -eq 10 ]; then
+  changed=true
+  code=0
+fi
+if [ -n "$GITHUB_OUTPUT" ]; then
+  echo "changed=$changed" >> "$GITHUB_OUTPUT"
+fi
+
+exit $code
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envReference matches ${VAR} and the escaped $${VAR}.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// placeholderNames are replaced by the tool itself and never expanded from
+// the environment.
+var placeholderNames = map[string]bool{"version": true, "version_tag": true, "file": true}
+
+// expandEnv replaces ${VAR} in the string fields and params of the source
+// with the environment variable VAR, so that a committed resource file can
+// refer to e.g. a base URL differing between environments. The placeholders
+// of the version and the names of params, which are passed to the scripts as
+// environment variables, are left alone, as is $${VAR}, which becomes ${VAR}.
+// Undefined variables are an error instead of being expanded to nothing.
+// Scripts are left to the shell, which expands the variables itself, so only
+// a metalink_get URL is expanded.
+func (s *Source) expandEnv() error {
+	type field struct {
+		name  string
+		value *string
+	}
+	fields := []field{
+		{"metalink_url", &s.MetalinkURL},
+		{"metalink_file", &s.MetalinkFile},
+		{"metalink_sha256", &s.MetalinkSha256},
+		{"version", &s.Version},
+		{"version_prefix", &s.VersionPrefix},
+		{"file_filter", &s.FileFilter},
+		{"version_constraint", &s.VersionConstraint},
+		{"signature_url", &s.SignatureURL},
+		{"signature_key", &s.SignatureKey},
+		{"version_include", &s.VersionInclude},
+		{"version_exclude", &s.VersionExclude},
+		{"os", &s.OS},
+		{"arch", &s.Arch},
+	}
+
+	// metalink_get is only expanded if it is a URL once expanded, otherwise
+	// it is a script
+	if expanded, err := s.expandEnvString(s.MetalinkGet); err == nil {
+		if _, ok := metalinkGetURL(expanded); ok {
+			s.MetalinkGet = expanded
+		}
+	}
+
+	for _, f := range fields {
+		expanded, err := s.expandEnvString(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s in 'source.%s'", err, f.name)
+		}
+		*f.value = expanded
+	}
+
+	for name, value := range s.Params {
+		expanded, err := s.expandEnvString(value)
+		if err != nil {
+			return fmt.Errorf("%s in 'source.params.%s'", err, name)
+		}
+		s.Params[name] = expanded
+	}
+
+	return nil
+}
+
+func (s *Source) expandEnvString(value string) (string, error) {
+	var undefined string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref[1] == '$' {
+			return ref[1:]
+		}
+		name := envReference.FindStringSubmatch(ref)[1]
+		if _, ok := s.Params[name]; ok || placeholderNames[name] {
+			return ref
+		}
+		envValue, ok := os.LookupEnv(name)
+		if !ok && undefined == "" {
+			undefined = name
+		}
+		return envValue
+	})
+
+	if undefined != "" {
+		return "", fmt.Errorf("undefined environment variable '%s'", undefined)
+	}
+	return expanded, nil
+}
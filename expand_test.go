@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceExpandEnv(t *testing.T) {
+	t.Setenv("MIRROR_URL", "https://mirror.example.com")
+
+	tests := []struct {
+		name    string
+		source  Source
+		want    Source
+		wantErr string
+	}{
+		{
+			name:   "urls and params",
+			source: Source{MetalinkURL: "${MIRROR_URL}/foo-${version}.meta4", Params: map[string]string{"base": "${MIRROR_URL}/foo"}},
+			want:   Source{MetalinkURL: "https://mirror.example.com/foo-${version}.meta4", Params: map[string]string{"base": "https://mirror.example.com/foo"}},
+		},
+		{
+			name:   "metalink_get url",
+			source: Source{MetalinkGet: "${MIRROR_URL}/${version}.meta4"},
+			want:   Source{MetalinkGet: "https://mirror.example.com/${version}.meta4"},
+		},
+		{
+			name: "scripts are left to the shell",
+			source: Source{
+				VersionCheck: `for v in ${UNDEFINED_LIST}; do echo "${v}"; done`,
+				MetalinkGet:  `curl "${MIRROR_URL}/${version}.meta4"`,
+				PostDownload: `tar -xzf "${file}" -C "${TMPDIR:-/tmp}"`,
+			},
+			want: Source{
+				VersionCheck: `for v in ${UNDEFINED_LIST}; do echo "${v}"; done`,
+				MetalinkGet:  `curl "${MIRROR_URL}/${version}.meta4"`,
+				PostDownload: `tar -xzf "${file}" -C "${TMPDIR:-/tmp}"`,
+			},
+		},
+		{
+			name:   "escaped reference",
+			source: Source{SignatureURL: "https://example.com/$${MIRROR_URL}"},
+			want:   Source{SignatureURL: "https://example.com/${MIRROR_URL}"},
+		},
+		{
+			name:    "undefined variable",
+			source:  Source{MetalinkURL: "${UNDEFINED_MIRROR_URL}/foo.meta4"},
+			wantErr: "undefined environment variable 'UNDEFINED_MIRROR_URL' in 'source.metalink_url'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source
+			err := source.expandEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if source.VersionCheck != tt.want.VersionCheck || source.MetalinkGet != tt.want.MetalinkGet ||
+				source.MetalinkURL != tt.want.MetalinkURL || source.SignatureURL != tt.want.SignatureURL ||
+				source.PostDownload != tt.want.PostDownload {
+				t.Errorf("source = %+v, want %+v", source, tt.want)
+			}
+			for name, value := range tt.want.Params {
+				if source.Params[name] != value {
+					t.Errorf("params.%s = %q, want %q", name, source.Params[name], value)
+				}
+			}
+		})
+	}
+}
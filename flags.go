@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileMode is a flag.Value for octal file permissions.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid file mode '%s'", value)
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// stringList is a flag.Value for comma-separated lists.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// mirrorMap is a flag.Value for comma-separated host=URL pairs, which map
+// upstream hosts to the base URL of their mirror.
+type mirrorMap map[string]string
+
+func (m *mirrorMap) String() string {
+	hosts := make([]string, 0, len(*m))
+	for host := range *m {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	pairs := make([]string, len(hosts))
+	for i, host := range hosts {
+		pairs[i] = fmt.Sprintf("%s=%s", host, (*m)[host])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *mirrorMap) Set(value string) error {
+	if *m == nil {
+		*m = mirrorMap{}
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			return fmt.Errorf("invalid mirror '%s' (expected host=URL)", item)
+		}
+
+		base := strings.TrimSpace(pair[1])
+		u, err := url.Parse(base)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid mirror URL '%s'", base)
+		}
+		(*m)[strings.ToLower(strings.TrimSpace(pair[0]))] = strings.TrimSuffix(base, "/")
+	}
+	return nil
+}
+
+// byteSize is a flag.Value for sizes like 512K, 10MB or 1GiB. The units K, M
+// and G are binary multiples.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	if *s == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*s))
+}
+
+func (s *byteSize) Set(value string) error {
+	number := strings.TrimRight(value, "BbiKkMmGg")
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value[len(number):]), "B"), "I")
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size '%s'", value)
+	}
+
+	switch unit {
+	case "":
+	case "K":
+		size *= 1 << 10
+	case "M":
+		size *= 1 << 20
+	case "G":
+		size *= 1 << 30
+	default:
+		return fmt.Errorf("invalid size '%s'", value)
+	}
+	*s = byteSize(size)
+	return nil
+}
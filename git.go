@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// git runs a git command in the directory and returns its trimmed output,
+// which is also included in the returned error. Secrets must be passed in the
+// environment, which is not logged.
+func git(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	debugf("Running git %s", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = scriptWaitDelay
+
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if ctx.Err() != nil {
+		return "", errors.Wrapf(ctx.Err(), "git %s", args[0])
+	}
+	if err != nil {
+		if output != "" {
+			return "", errors.Wrapf(err, "git %s: %s", args[0], output)
+		}
+		return "", errors.Wrapf(err, "git %s", args[0])
+	}
+
+	return output, nil
+}
+
+// committerEnv returns the environment setting the committer to the author
+// "Name <email>", unless the committer is configured in the environment
+// already. This allows committing in CI without a git identity.
+func committerEnv(author string) ([]string, error) {
+	if author == "" {
+		return nil, nil
+	}
+
+	address, err := mail.ParseAddress(author)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git author '%s' (expected 'Name <email>')", author)
+	}
+
+	var env []string
+	if _, ok := os.LookupEnv("GIT_COMMITTER_NAME"); !ok {
+		env = append(env, "GIT_COMMITTER_NAME="+address.Name)
+	}
+	if _, ok := os.LookupEnv("GIT_COMMITTER_EMAIL"); !ok {
+		env = append(env, "GIT_COMMITTER_EMAIL="+address.Address)
+	}
+	return env, nil
+}
+
+// commitMessage returns the message of a commit of the upgraded and pruned
+// packages.
+func commitMessage(results []*packageResult) string {
+	var upgraded []*packageResult
+	var lines []string
+	for _, r := range results {
+		if r.Action == actionUpgraded {
+			upgraded = append(upgraded, r)
+			oldVersion := r.OldVersion
+			if oldVersion == "" {
+				oldVersion = "-"
+			}
+			lines = append(lines, fmt.Sprintf("- %s: %s -> %s", r.Package, oldVersion, r.NewVersion))
+		}
+		if len(r.Pruned) > 0 {
+			lines = append(lines, fmt.Sprintf("- %s: pruned %s", r.Package, strings.Join(r.Pruned, ", ")))
+		}
+	}
+
+	subject := fmt.Sprintf("Upgrade blobs of %d packages", len(upgraded))
+	switch {
+	case len(upgraded) == 1:
+		subject = fmt.Sprintf("Upgrade %s to %s", upgraded[0].Package, upgraded[0].NewVersion)
+	case len(upgraded) == 0:
+		subject = "Prune stale blobs"
+	}
+
+	return subject + "\n\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// commitChanges commits blobs.yml, the version files written by the run and
+// the changelog if any package was upgraded or pruned. Other changes of the
+// repository are left alone.
+func (u *Upgrader) commitChanges(ctx context.Context, report *summary) error {
+	if !report.Changed() {
+		return nil
+	}
+
+	paths := []string{filepath.Join(u.configDir(), "blobs.yml")}
+	for _, r := range report.Results {
+		if r.versionFile == "" {
+			continue
+		}
+		paths = append(paths, r.versionFile)
+		if len(r.validators) > 0 {
+			paths = append(paths, filepath.Join(filepath.Dir(r.versionFile), validatorsFileName))
+		}
+	}
+
+	// the changelog is committed as well if it belongs to the release
+	if changelog := u.Options.Changelog; changelog != "" {
+		absChangelog, err := filepath.Abs(changelog)
+		if err != nil {
+			return err
+		}
+		absReleaseDir, err := filepath.Abs(u.ReleaseDir)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(absReleaseDir, absChangelog)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			paths = append(paths, absChangelog)
+		}
+	}
+
+	env, err := committerEnv(u.Options.GitAuthor)
+	if err != nil {
+		return err
+	}
+
+	// git runs in the release directory, while the paths are relative to
+	// the working directory
+	for i, path := range paths {
+		paths[i], err = filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = git(ctx, u.ReleaseDir, nil, append([]string{"add", "--"}, paths...)...)
+	if err != nil {
+		return errors.Wrap(err, "staging changes")
+	}
+
+	args := []string{"commit", "--quiet", "--message", commitMessage(report.Results)}
+	if u.Options.GitAuthor != "" {
+		args = append(args, "--author", u.Options.GitAuthor)
+	}
+	_, err = git(ctx, u.ReleaseDir, env, append(append(args, "--"), paths...)...)
+	if err != nil {
+		return errors.Wrap(err, "committing changes")
+	}
+
+	infof("Committed changes of %s.", u.ReleaseDir)
+	return nil
+}
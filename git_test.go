@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommitChangesRelativeReleaseDir(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := context.Background()
+
+	workDir := t.TempDir()
+	packageDir := filepath.Join(workDir, "release", "config", "blobs", "foo")
+	if err := os.MkdirAll(packageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git(ctx, filepath.Join(workDir, "release"), nil, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// the paths are relative to the working directory, not to the release
+	versionFile := filepath.Join("release", "config", "blobs", "foo", "version")
+	for path, content := range map[string]string{
+		filepath.Join("release", "config", "blobs.yml"): "foo/foo-1.1.0.tgz:\n  size: 11\n  sha: sha256:abc\n",
+		versionFile: "1.1.0",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := &Upgrader{
+		ReleaseDir: "release",
+		Options:    options{ConfigDir: "config", GitAuthor: "Upgrader <upgrader@example.com>"},
+	}
+	report := &summary{Results: []*packageResult{
+		{Package: "foo", Action: actionUpgraded, OldVersion: "1.0.0", NewVersion: "1.1.0", versionFile: versionFile},
+	}}
+
+	if err := u.commitChanges(ctx, report); err != nil {
+		t.Fatalf("commitChanges: %v", err)
+	}
+
+	subject, err := git(ctx, "release", nil, "log", "-1", "--format=%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Upgrade foo to 1.1.0" {
+		t.Errorf("subject = %q, want %q", subject, "Upgrade foo to 1.1.0")
+	}
+
+	files, err := git(ctx, "release", nil, "show", "--name-only", "--format=", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "config/blobs.yml\nconfig/blobs/foo/version"
+	if files != want {
+		t.Errorf("committed files = %q, want %q", strings.Split(files, "\n"), strings.Split(want, "\n"))
+	}
+}
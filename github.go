@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// githubTimeout is the timeout of a GitHub API request.
+const githubTimeout = 30 * time.Second
+
+// githubConfig is the repository and credentials of pull requests, read from
+// the environment variables set in GitHub Actions.
+type githubConfig struct {
+	Token     string
+	APIURL    string
+	ServerURL string
+	Owner     string
+	Repo      string
+}
+
+// githubConfigFromEnv reads GITHUB_TOKEN and GITHUB_REPOSITORY, and the
+// optional GITHUB_API_URL and GITHUB_SERVER_URL of GitHub Enterprise.
+func githubConfigFromEnv() (githubConfig, error) {
+	token, err := getStrictFromEnv("GITHUB_TOKEN")
+	if err != nil {
+		return githubConfig{}, err
+	}
+
+	repository, err := getStrictFromEnv("GITHUB_REPOSITORY")
+	if err != nil {
+		return githubConfig{}, err
+	}
+	parts := strings.Split(repository, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return githubConfig{}, fmt.Errorf("invalid GITHUB_REPOSITORY '%s' (expected 'owner/repo')", repository)
+	}
+
+	return githubConfig{
+		Token:     token,
+		APIURL:    strings.TrimSuffix(getFromEnv("GITHUB_API_URL", "https://api.github.com"), "/"),
+		ServerURL: strings.TrimSuffix(getFromEnv("GITHUB_SERVER_URL", "https://github.com"), "/"),
+		Owner:     parts[0],
+		Repo:      parts[1],
+	}, nil
+}
+
+// pushEnv returns the environment authenticating git with the token. It
+// replaces the credentials persisted by actions/checkout.
+func (c githubConfig) pushEnv() []string {
+	key := fmt.Sprintf("http.%s/.extraheader", c.ServerURL)
+	auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + c.Token))
+	return []string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=" + key,
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=" + key,
+		"GIT_CONFIG_VALUE_1=AUTHORIZATION: basic " + auth,
+	}
+}
+
+// createPullRequest opens a pull request of the head branch into the base
+// branch with the client and returns its URL.
+func (c githubConfig) createPullRequest(ctx context.Context, client *http.Client, title, body, head, base string) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"title": title,
+		"body":  body,
+		"head":  head,
+		"base":  base,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, githubTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/repos/%s/%s/pulls", c.APIURL, c.Owner, c.Repo)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errorBodyLimit))
+	var result struct {
+		HTMLURL string `json:"html_url"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &result)
+
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return result.HTMLURL, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "", fmt.Errorf("GITHUB_TOKEN was rejected: %s", result.Message)
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("GITHUB_TOKEN lacks permission to open pull requests in '%s/%s' "+
+			"(requires 'contents: write' and 'pull-requests: write'): %s", c.Owner, c.Repo, result.Message)
+	default:
+		return "", fmt.Errorf("unexpected response '%s': %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+}
+
+// pullRequestBody returns a markdown table of the upgraded and pruned
+// packages.
+func pullRequestBody(results []*packageResult) string {
+	var b strings.Builder
+	b.WriteString("| Package | Old version | New version | SHA |\n")
+	b.WriteString("|---------|-------------|-------------|-----|\n")
+	for _, r := range results {
+		if r.Action != actionUpgraded {
+			continue
+		}
+		oldVersion := r.OldVersion
+		if oldVersion == "" {
+			oldVersion = "-"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | `%s` |\n", r.Package, oldVersion, r.NewVersion, r.NewSha)
+	}
+
+	for _, r := range results {
+		if len(r.Pruned) > 0 {
+			fmt.Fprintf(&b, "\nPruned blobs of `%s`: %s\n", r.Package, strings.Join(r.Pruned, ", "))
+		}
+	}
+
+	return b.String()
+}
+
+// unsafeRefChars matches characters which are replaced in branch names.
+var unsafeRefChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// branchName returns the name of the pull request branch of the release. It
+// contains the release name, the time and a random suffix, since several
+// releases may be upgraded in the same second.
+func (u *Upgrader) branchName() (string, error) {
+	releaseDir, err := filepath.Abs(u.ReleaseDir)
+	if err != nil {
+		return "", err
+	}
+	release := strings.Trim(unsafeRefChars.ReplaceAllString(filepath.Base(releaseDir), "-"), ".-")
+	if release == "" {
+		release = "release"
+	}
+
+	suffix := make([]byte, 3)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", errors.Wrap(err, "generating branch name")
+	}
+
+	return fmt.Sprintf("bosh-blobs-upgrader/%s-%s-%x", release, u.Clock.Now().UTC().Format("20060102-150405"), suffix), nil
+}
+
+// openPullRequest commits the changes on a new branch, pushes it and opens a
+// pull request into the base branch, which defaults to the current branch.
+// The current branch is checked out again afterwards.
+func (u *Upgrader) openPullRequest(ctx context.Context, report *summary) error {
+	if !report.Changed() {
+		return nil
+	}
+
+	gh, err := githubConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// the API is reached with the proxy and TLS settings of the downloads
+	client, err := newHTTPClient(u.Options)
+	if err != nil {
+		return errors.Wrap(err, "configuring GitHub API requests")
+	}
+
+	current, err := git(ctx, u.ReleaseDir, nil, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return errors.Wrap(err, "determining current branch")
+	}
+	base := u.Options.GitHubBase
+	if base == "" {
+		base = current
+	}
+
+	branch, err := u.branchName()
+	if err != nil {
+		return err
+	}
+	_, err = git(ctx, u.ReleaseDir, nil, "checkout", "--quiet", "-b", branch)
+	if err != nil {
+		return errors.Wrap(err, "creating branch")
+	}
+	defer func() {
+		// the original branch is checked out again even if the run was
+		// cancelled, so the release is not left on the pull request branch
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := git(ctx, u.ReleaseDir, nil, "checkout", "--quiet", current)
+		if err != nil {
+			warnf("checking out '%s' again: %v", current, err)
+		}
+	}()
+
+	err = u.commitChanges(ctx, report)
+	if err != nil {
+		return err
+	}
+
+	remote := fmt.Sprintf("%s/%s/%s.git", gh.ServerURL, gh.Owner, gh.Repo)
+	_, err = git(ctx, u.ReleaseDir, gh.pushEnv(), "push", "--quiet", remote, "HEAD:refs/heads/"+branch)
+	if err != nil {
+		return errors.Wrapf(err, "pushing branch '%s' (GITHUB_TOKEN requires 'contents: write')", branch)
+	}
+
+	message := commitMessage(report.Results)
+	title := strings.SplitN(message, "\n", 2)[0]
+	url, err := gh.createPullRequest(ctx, client, title, pullRequestBody(report.Results), branch, base)
+	if err != nil {
+		return errors.Wrap(err, "opening pull request")
+	}
+
+	infof("Opened pull request %s", url)
+	return nil
+}
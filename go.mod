@@ -1,6 +1,18 @@
 module github.com/s4heid/bosh-blobs-upgrader-action
 
-go 1.13
+go 1.20
+
+require (
+	github.com/cloudfoundry/bosh-cli v6.1.1+incompatible
+	github.com/cloudfoundry/bosh-utils v0.0.0-20191123100134-1519f14bace7
+	github.com/dpb587/dynamic-metalink-resource v1.0.0
+	github.com/dpb587/metalink v0.3.0
+	github.com/hashicorp/go-version v1.2.0
+	github.com/pkg/errors v0.8.1
+	golang.org/x/crypto v0.0.0-20191122220453-ac88ee75c92c
+	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933
+	gopkg.in/yaml.v2 v2.2.7
+)
 
 require (
 	cloud.google.com/go v0.49.0 // indirect
@@ -13,25 +25,24 @@ require (
 	github.com/charlievieth/fs v0.0.0-20170613215519-7dc373669fa1 // indirect
 	github.com/cheggaaa/pb v1.0.28 // indirect
 	github.com/cloudfoundry/bosh-agent v2.282.0+incompatible // indirect
-	github.com/cloudfoundry/bosh-cli v6.1.1+incompatible
 	github.com/cloudfoundry/bosh-davcli v0.0.44 // indirect
 	github.com/cloudfoundry/bosh-gcscli v0.0.16 // indirect
 	github.com/cloudfoundry/bosh-s3cli v0.0.92 // indirect
-	github.com/cloudfoundry/bosh-utils v0.0.0-20191123100134-1519f14bace7
 	github.com/cloudfoundry/config-server v0.1.20 // indirect
 	github.com/cloudfoundry/go-socks5 v0.0.0-20180221174514-54f73bdb8a8e // indirect
 	github.com/cloudfoundry/socks5-proxy v0.2.0 // indirect
 	github.com/cppforlife/go-patch v0.2.0 // indirect
 	github.com/cppforlife/go-semi-semantic v0.0.0-20160921010311-576b6af77ae4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/dpb587/dynamic-metalink-resource v1.0.0
-	github.com/dpb587/metalink v0.3.0
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/golang/groupcache v0.0.0-20191027212112-611e8accdfc9 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.0.0 // indirect
-	github.com/hashicorp/go-version v1.2.0
 	github.com/jessevdk/go-flags v1.4.0 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/jstemmer/go-junit-report v0.9.1 // indirect
 	github.com/kr/pty v1.1.8 // indirect
@@ -40,21 +51,19 @@ require (
 	github.com/mattn/go-runewidth v0.0.6 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	github.com/pivotal-cf/paraphernalia v0.0.0-20180203224945-a64ae2051c20 // indirect
-	github.com/pkg/errors v0.8.1
 	github.com/square/certstrap v1.2.0 // indirect
 	github.com/tedsuo/ifrit v0.0.0-20191009134036-9a97d0632f00 // indirect
 	github.com/vito/go-interact v1.0.0 // indirect
 	go.opencensus.io v0.22.2 // indirect
-	golang.org/x/crypto v0.0.0-20191122220453-ac88ee75c92c // indirect
 	golang.org/x/exp v0.0.0-20191127035308-9964a5a80460 // indirect
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f // indirect
-	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933 // indirect
 	golang.org/x/oauth2 v0.0.0-20191122200657-5d9234df094c // indirect
 	golang.org/x/sys v0.0.0-20191127021746-63cb32ae39b2 // indirect
+	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20191127201027-ecd32218bd7f // indirect
+	google.golang.org/api v0.14.0 // indirect
 	google.golang.org/appengine v1.6.5 // indirect
 	google.golang.org/genproto v0.0.0-20191115221424-83cc0476cb11 // indirect
 	google.golang.org/grpc v1.25.1 // indirect
 	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
-	gopkg.in/yaml.v2 v2.2.7
 )
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// postDownloadHook runs the post_download script of the source on downloaded
+// files, e.g. to repackage or re-sign them before they are added as blobs.
+type postDownloadHook struct {
+	Script  string
+	Env     map[string]string
+	Timeout time.Duration
+	Digest  string
+}
+
+// newPostDownloadHook returns the hook of the post_download script of the
+// source, or nil if there is none.
+func newPostDownloadHook(source Source, version *taggedVersion, opts options) *postDownloadHook {
+	if strings.TrimSpace(source.PostDownload) == "" {
+		return nil
+	}
+
+	return &postDownloadHook{
+		Script:  source.PostDownload,
+		Env:     scriptEnv(source, version),
+		Timeout: opts.ScriptTimeout,
+		Digest:  string(opts.DigestAlgorithm),
+	}
+}
+
+// Run runs the script with the absolute path of the downloaded file in the
+// variable 'file'. The last line printed by the script is the path of the
+// file to add instead, relative to the directory of the downloaded file;
+// without output, the downloaded file is added, which the script may have
+// changed in place. The returned blob has the digests of the file to add.
+func (h *postDownloadHook) Run(ctx context.Context, filePath string) (string, Blob, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", Blob{}, err
+	}
+
+	env := map[string]string{}
+	for name, value := range h.Env {
+		env[name] = value
+	}
+	env["file"] = absPath
+
+	stdout, err := runScript(ctx, h.Timeout, h.Script, env)
+	if err != nil {
+		return "", Blob{}, err
+	}
+
+	outputPath := filePath
+	if lines := strings.Split(strings.TrimSpace(string(stdout)), "\n"); lines[len(lines)-1] != "" {
+		outputPath = strings.TrimSpace(lines[len(lines)-1])
+		if !filepath.IsAbs(outputPath) {
+			outputPath = filepath.Join(filepath.Dir(filePath), outputPath)
+		}
+	}
+
+	hashes, hashers := newDigestHashes()
+	err = hashFile(outputPath, io.MultiWriter(hashers...))
+	if err != nil {
+		return "", Blob{}, errors.Wrapf(err, "hashing output file '%s'", outputPath)
+	}
+
+	blob := Blob{digests: sumDigests(hashes)}
+	blob.Sha = formatDigest(h.Digest, blob.digests[h.Digest])
+	return outputPath, blob, nil
+}
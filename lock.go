@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockFileName is the name of the lock file in the release dir.
+const lockFileName = ".blobs-upgrader.lock"
+
+// lockPollInterval is the delay between attempts to acquire a held lock.
+const lockPollInterval = 100 * time.Millisecond
+
+// acquireLock takes an exclusive lock of the release dir, waiting up to the
+// timeout for another run to release it. The returned function releases the
+// lock.
+func acquireLock(releaseDir string, timeout time.Duration) (func(), error) {
+	lockPath := filepath.Join(releaseDir, lockFileName)
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrap(err, "locking release directory")
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, errors.Errorf("release directory '%s' is locked by another run (see -lock-timeout)", releaseDir)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
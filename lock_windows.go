@@ -0,0 +1,8 @@
+package main
+
+import "time"
+
+// acquireLock does not lock the release dir on Windows, which lacks flock.
+func acquireLock(releaseDir string, timeout time.Duration) (func(), error) {
+	return func() {}, nil
+}
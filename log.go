@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logLevel is the minimum level of printed messages. It is a flag.Value.
+type logLevel int
+
+// Log levels in increasing severity.
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l *logLevel) String() string {
+	if *l < levelDebug || *l > levelError {
+		return "unknown"
+	}
+	return logLevelNames[*l]
+}
+
+func (l *logLevel) Set(value string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(value, name) {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level '%s' (expected one of %s)", value, strings.Join(logLevelNames, ", "))
+}
+
+// currentLogLevel filters the messages printed by the log functions.
+var currentLogLevel = levelInfo
+
+// logOutput and logErrorOutput receive the messages below and from the error
+// level on.
+var (
+	logOutput      io.Writer = os.Stdout
+	logErrorOutput io.Writer = os.Stderr
+)
+
+// logMutex serializes messages of concurrently checked packages.
+var logMutex sync.Mutex
+
+func logf(level logLevel, prefix, format string, args ...interface{}) {
+	if level < currentLogLevel {
+		return
+	}
+	w := logOutput
+	if level >= levelError {
+		w = logErrorOutput
+	}
+	switch level {
+	case levelWarn:
+		prefix = colorize(colorYellow, prefix)
+	case levelError:
+		prefix = colorize(colorRed, prefix)
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	fmt.Fprintf(w, prefix+format+"\n", args...)
+}
+
+// debugf prints details like mirrors, timings and bosh commands.
+func debugf(format string, args ...interface{}) {
+	logf(levelDebug, "Debug: ", format, args...)
+}
+
+// infof prints the progress of the upgrade.
+func infof(format string, args ...interface{}) {
+	logf(levelInfo, "", format, args...)
+}
+
+// warnf prints problems which do not fail the upgrade.
+func warnf(format string, args ...interface{}) {
+	logf(levelWarn, "Warning: ", format, args...)
+}
+
+// errorf prints errors to stderr.
+func errorf(format string, args ...interface{}) {
+	logf(levelError, "Error: ", format, args...)
+}
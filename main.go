@@ -2,41 +2,119 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
-
-	boshcmd "github.com/cloudfoundry/bosh-cli/cmd"
-	bilog "github.com/cloudfoundry/bosh-cli/logger"
-	boshui "github.com/cloudfoundry/bosh-cli/ui"
-	boshlog "github.com/cloudfoundry/bosh-utils/logger"
-	"github.com/hashicorp/go-version"
+	"time"
 
 	"github.com/dpb587/dynamic-metalink-resource/api"
-	"github.com/dpb587/metalink"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
+// buildVersion is the version of the binary, set at build time via
+// -ldflags "-X main.buildVersion=...".
+var buildVersion = "dev"
+
+// Exit codes besides 0 for no changes, 1 for errors and 2 for usage errors.
+const (
+	// exitChangesPending is the exit code of a dry run or check with pending
+	// upgrades.
+	exitChangesPending = 3
+	// exitChangesApplied is the exit code of a run which upgraded blobs.
+	exitChangesApplied = 10
+)
+
+// options holds the command line options.
+type options struct {
+	DryRun            bool
+	Check             bool
+	HTTPTimeout       time.Duration
+	Retries           int
+	FileMode          fileMode
+	Only              stringList
+	ReportJSON        string
+	Proxy             string
+	NoProxy           string
+	SkipUpload        bool
+	Verbose           bool
+	Progress          bool
+	VersionCacheTTL   time.Duration
+	NoCache           bool
+	ScriptTimeout     time.Duration
+	CheckWorkers      int
+	Prune             bool
+	AllowDowngrade    bool
+	IncludePrerelease bool
+	Force             bool
+	FailFast          bool
+	LockTimeout       time.Duration
+	RateLimit         byteSize
+	Quiet             bool
+	Mirrors           mirrorMap
+	ConfigDir         string
+	TLSCert           string
+	TLSKey            string
+	TLSCA             string
+	Insecure          bool
+	InsecureHosts     stringList
+	GitCommit         bool
+	GitAuthor         string
+	GitHubPR          bool
+	GitHubBase        string
+	NotifyURL         string
+	NotifyAlways      bool
+	Changelog         string
+	MaxSize           byteSize
+	UserAgent         string
+	MaxRedirects      int
+	SkipContentCheck  bool
+	PrintCommands     bool
+	BoshBin           string
+	DigestAlgorithm   digestAlgorithm
+	Offline           bool
+	TmpDir            string
+	CleanupDownloads  bool
+	KeepDownloads     int
+	PrivateConfig     string
+	MetricsFile       string
+	Timeout           time.Duration
+}
+
 // ResourceConfig .
 type ResourceConfig struct {
-	Source  Source      `yaml:"source"`
-	Version api.Version `yaml:"version"`
+	Source      Source      `yaml:"source"`
+	Version     api.Version `yaml:"version"`
+	PackageName string      `yaml:"package_name,omitempty"`
 }
 
 // Source .
 type Source struct {
-	VersionCheck string `yaml:"version_check"`
-	MetalinkGet  string `yaml:"metalink_get"`
-	Version      string `yaml:"version,omitempty"`
+	VersionCheck      string            `yaml:"version_check"`
+	MetalinkGet       string            `yaml:"metalink_get,omitempty"`
+	MetalinkURL       string            `yaml:"metalink_url,omitempty"`
+	MetalinkFile      string            `yaml:"metalink_file,omitempty"`
+	MetalinkSha256    string            `yaml:"metalink_sha256,omitempty"`
+	Version           string            `yaml:"version,omitempty"`
+	VersionPrefix     string            `yaml:"version_prefix,omitempty"`
+	FileFilter        string            `yaml:"file_filter,omitempty"`
+	VersionConstraint string            `yaml:"version_constraint,omitempty"`
+	SignatureURL      string            `yaml:"signature_url,omitempty"`
+	SignatureKey      string            `yaml:"signature_key,omitempty"`
+	Params            map[string]string `yaml:"params,omitempty"`
+	AllowPrerelease   bool              `yaml:"allow_prerelease,omitempty"`
+	VersionInclude    string            `yaml:"version_include,omitempty"`
+	VersionExclude    string            `yaml:"version_exclude,omitempty"`
+	OS                string            `yaml:"os,omitempty"`
+	Arch              string            `yaml:"arch,omitempty"`
+	PostDownload      string            `yaml:"post_download,omitempty"`
 }
 
 // Blob .
@@ -46,69 +124,138 @@ type Blob struct {
 	ID          string `yaml:"object_id"`
 	Size        string `yaml:"size"`
 	Sha         string `yaml:"sha"`
+
+	// digests are the sums of a downloaded blob by algorithm
+	digests map[string]string
 }
 
 // Blobs .
 type Blobs map[string]*Blob
 
-func sha256sum(filepath string) (string, error) {
-	f, err := os.Open(filepath)
+// Unmarshal .
+func (s *Blobs) Unmarshal(data []byte) error {
+	err := yaml.NewDecoder(bytes.NewReader(data)).Decode(s)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+	for k, v := range *s {
+		v.Path = strings.TrimSpace(string(k))
+		v.PackageName = strings.Split(v.Path, "/")[0]
 	}
-
-	return fmt.Sprintf("%x", h.Sum(nil)), err
+	return nil
 }
 
-// DownloadFile will download a url to a local file
-func DownloadFile(filepath, url string) (Blob, error) {
-	fmt.Printf("Downloading %s from %s\n", filepath, url)
-
-	var blob Blob
-	resp, err := http.Get(url)
+// readBlobs reads the blobs of the release from blobs.yml in the config
+// directory.
+func readBlobs(configDir string) (Blobs, error) {
+	blobsData, err := ioutil.ReadFile(filepath.Join(configDir, "blobs.yml"))
 	if err != nil {
-		return blob, err
+		return nil, errors.Wrap(err, "reading blobs file")
 	}
-	defer resp.Body.Close()
 
-	out, err := os.Create(filepath)
+	var blobs Blobs = map[string]*Blob{}
+	err = blobs.Unmarshal(blobsData)
 	if err != nil {
-		return blob, err
+		return nil, errors.Wrap(err, "decoding blobs file")
 	}
-	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
 
-	err = os.Chmod(filepath, 0777)
-	if err != nil {
-		return blob, fmt.Errorf("changing permissions: %v", err)
+	return blobs, nil
+}
+
+// AssignPackages sets the package name of each blob to the longest package
+// name which is a directory prefix of the blob path. Blobs of unknown packages
+// keep the first path segment as package name.
+func (s Blobs) AssignPackages(packageNames []string) {
+	for _, b := range s {
+		longest := ""
+		for _, name := range packageNames {
+			if strings.HasPrefix(b.Path, name+"/") && len(name) > len(longest) {
+				longest = name
+			}
+		}
+		if longest != "" {
+			b.PackageName = longest
+		}
 	}
+}
+
+// findResourceFiles returns the resource files of all packages below the
+// blobs directory of the config directory, keyed by package name. The package
+// name is the path of the directory containing the resource file relative to
+// the blobs directory, unless the resource file sets a package_name.
+func findResourceFiles(configDir string) (map[string]string, error) {
+	blobsDir := filepath.Join(configDir, "blobs")
+	resourcePaths := map[string]string{}
+
+	err := filepath.Walk(blobsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == blobsDir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != "resource.yml" {
+			return nil
+		}
 
-	sha, err := sha256sum(filepath)
+		packageDir, err := filepath.Rel(blobsDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if packageDir == "." {
+			return nil
+		}
+
+		packageName := filepath.ToSlash(packageDir)
+		if override := readPackageName(path); override != "" {
+			packageName = override
+		}
+		if other, ok := resourcePaths[packageName]; ok {
+			return fmt.Errorf("resource files '%s' and '%s' both configure package '%s'", other, path, packageName)
+		}
+		resourcePaths[packageName] = path
+		return nil
+	})
+
+	return resourcePaths, err
+}
+
+// readPackageName returns the package_name of the resource file, which
+// overrides the name of its directory for matching blobs. Errors are left to
+// readResourceConfig, which reports them for the package.
+func readPackageName(resourcePath string) string {
+	data, err := ioutil.ReadFile(resourcePath)
 	if err != nil {
-		return blob, fmt.Errorf("calculating shasum: %v", err)
+		return ""
 	}
-	blob.Sha = fmt.Sprintf("sha256:%s", sha)
-
-	return blob, err
+	var resourceConfig ResourceConfig
+	_ = yaml.Unmarshal(data, &resourceConfig)
+	return strings.Trim(strings.TrimSpace(resourceConfig.PackageName), "/")
 }
 
-// Unmarshal .
-func (s *Blobs) Unmarshal(data []byte) error {
-	err := yaml.NewDecoder(bytes.NewReader(data)).Decode(s)
+// readPackagesFile returns the package names listed in the file, one per
+// line. Blank lines and lines starting with '#' are ignored.
+func readPackagesFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "reading packages file")
 	}
-	for k, v := range *s {
-		v.Path = strings.TrimSpace(string(k))
-		v.PackageName = strings.Split(v.Path, "/")[0]
+
+	var packageNames []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		packageNames = append(packageNames, line)
 	}
-	return nil
+
+	// an empty list would silently upgrade all packages
+	if len(packageNames) == 0 {
+		return nil, fmt.Errorf("packages file '%s' lists no packages", path)
+	}
+
+	return packageNames, nil
 }
 
 func getFromEnv(key, fallback string) string {
@@ -118,6 +265,17 @@ func getFromEnv(key, fallback string) string {
 	return fallback
 }
 
+func getDurationFromEnv(key string, fallback time.Duration) (time.Duration, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fallback, errors.Wrapf(err, "parsing variable %q", key)
+		}
+		return d, nil
+	}
+	return fallback, nil
+}
+
 func getStrictFromEnv(key string) (string, error) {
 	if value, ok := os.LookupEnv(key); ok {
 		return value, nil
@@ -125,178 +283,281 @@ func getStrictFromEnv(key string) (string, error) {
 	return "", errors.New(fmt.Sprintf("variable %q not set in environment", key))
 }
 
-func bosh(args []string) error {
-	level := boshlog.LevelNone
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
-	logger, _ := bilog.NewSignalableLogger(boshlog.NewLogger(level), c)
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM. A
+// second signal terminates the process immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
 
-	ui := boshui.NewConfUI(logger)
-	defer ui.Flush()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-c:
+			fmt.Fprintf(os.Stderr, "Received %s, aborting...\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+	}()
 
-	cmdFactory := boshcmd.NewFactory(boshcmd.NewBasicDeps(ui, logger))
+	return ctx, cancel
+}
 
-	cmd, err := cmdFactory.New(args)
+// checkBlobstoreCredentials verifies that the private config holding the
+// blobstore credentials required by upload-blobs exists. It is private.yml
+// in the config directory unless the privatePath is given.
+func checkBlobstoreCredentials(configDir, privatePath string) error {
+	if privatePath == "" {
+		privatePath = filepath.Join(configDir, "private.yml")
+	}
+	_, err := os.Stat(privatePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("blobstore credentials not set: expected '%s' with the blobstore options of final.yml, "+
+			"e.g. 'blobstore.options.access_key_id' and 'secret_access_key' for S3 or 'json_key' for GCS (or use -skip-upload)", privatePath)
+	}
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "checking blobstore credentials")
 	}
-
-	return cmd.Execute()
-}
-
-func boshAddBlob(filePath, blobPath, releaseDir string) error {
-	return bosh([]string{"add-blob", fmt.Sprintf("--dir=%s", releaseDir), filePath, blobPath})
+	return nil
 }
 
-func boshRemoveBlob(blobPath, releaseDir string) error {
-	return bosh([]string{"remove-blob", fmt.Sprintf("--dir=%s", releaseDir), blobPath})
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [release-dir...]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(flag.CommandLine.Output(), "Upgrades the blobs of a bosh release from their upstream resources.")
+	fmt.Fprintln(flag.CommandLine.Output(), "\nOptions:")
+	flag.PrintDefaults()
+	fmt.Fprintln(flag.CommandLine.Output(), "\nExit codes:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  0\tno changes")
+	fmt.Fprintln(flag.CommandLine.Output(), "  1\terror")
+	fmt.Fprintln(flag.CommandLine.Output(), "  2\tusage error")
+	fmt.Fprintf(flag.CommandLine.Output(), "  %d\tupgrades pending (-dry-run or -check)\n", exitChangesPending)
+	fmt.Fprintf(flag.CommandLine.Output(), "  %d\tupgrades applied\n", exitChangesApplied)
 }
 
-func boshUploadBlobs(releaseDir string) error {
-	return bosh([]string{"upload-blobs", fmt.Sprintf("--dir=%s", releaseDir)})
+func usageError(msg string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "Error: %s\n\n", msg)
+	flag.Usage()
+	os.Exit(2)
 }
 
 func main() {
 	var (
-		err        error
-		releaseDir string
+		err          error
+		releaseDirs  stringList
+		debug        bool
+		showVersion  bool
+		configPath   string
+		packagesFile string
+		color        colorMode
+		opts         options
 	)
 
-	if len(os.Args) == 2 {
-		releaseDir = os.Args[1]
-	} else {
-		releaseDir, err = os.Getwd()
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	os.Setenv("BOSH_NON_INTERACTIVE", "true")
-
-	blobsData, err := ioutil.ReadFile(filepath.Join(releaseDir, "config", "blobs.yml"))
+	httpTimeout, err := getDurationFromEnv("BLOBS_UPGRADER_HTTP_TIMEOUT", 30*time.Minute)
 	if err != nil {
-		panic(err)
+		usageError(err.Error())
 	}
 
-	var blobs Blobs = map[string]*Blob{}
-	err = blobs.Unmarshal([]byte(blobsData))
+	err = currentLogLevel.Set(getFromEnv("BLOBS_UPGRADER_LOG_LEVEL", "info"))
 	if err != nil {
-		log.Fatalf("decoding blobs file: %v", err)
+		usageError(errors.Wrap(err, "parsing variable \"BLOBS_UPGRADER_LOG_LEVEL\"").Error())
 	}
 
-	resourcePaths, err := filepath.Glob(filepath.Join(releaseDir, "config", "blobs", "*", "resource.yml"))
-	if err != nil {
-		panic(err)
+	flag.Usage = usage
+	flag.Var(&currentLogLevel, "log-level", "minimum level of printed messages: debug, info, warn or error (env: BLOBS_UPGRADER_LOG_LEVEL)")
+	flag.Var(&releaseDirs, "dir", "comma-separated paths of bosh releases, may be repeated (default: current directory)")
+	flag.StringVar(&configPath, "config", "", "path to a config file setting defaults of options (default: "+configFileName+" in the release directory)")
+	flag.StringVar(&opts.ConfigDir, "config-dir", "config", "directory containing blobs.yml and the resource files, relative to the release directory")
+	flag.BoolVar(&debug, "debug", getFromEnv("BLOBS_UPGRADER_DEBUG", "") != "", "print stack traces of errors")
+	flag.StringVar(&opts.Proxy, "proxy", "", "proxy URL for downloads (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	flag.StringVar(&opts.TLSCert, "tls-cert", getFromEnv("BLOBS_UPGRADER_TLS_CERT", ""), "PEM file of the client certificate presented to download servers (env: BLOBS_UPGRADER_TLS_CERT)")
+	flag.StringVar(&opts.TLSKey, "tls-key", getFromEnv("BLOBS_UPGRADER_TLS_KEY", ""), "PEM file of the key of the client certificate (env: BLOBS_UPGRADER_TLS_KEY)")
+	flag.StringVar(&opts.TLSCA, "tls-ca", getFromEnv("BLOBS_UPGRADER_TLS_CA", ""), "PEM file of CA certificates trusted by downloads in addition to the system ones (env: BLOBS_UPGRADER_TLS_CA)")
+	flag.BoolVar(&opts.Insecure, "insecure", false, "skip the verification of TLS certificates of download servers")
+	flag.Var(&opts.InsecureHosts, "insecure-hosts", "comma-separated hosts whose TLS certificates are not verified, instead of all hosts of -insecure")
+	flag.StringVar(&opts.UserAgent, "user-agent", getFromEnv("BLOBS_UPGRADER_USER_AGENT", "bosh-blobs-upgrader/"+buildVersion), "User-Agent header of download requests (env: BLOBS_UPGRADER_USER_AGENT)")
+	flag.StringVar(&opts.NoProxy, "no-proxy", "", "comma-separated hosts downloaded without proxy (default: NO_PROXY from the environment)")
+	flag.BoolVar(&opts.Progress, "progress", isTerminal(os.Stdout), "print the progress of downloads (default: true if stdout is a terminal)")
+	flag.Var(&color, "color", "colorize the output: auto, always or never (default: auto, colors if stdout is a terminal)")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "only print warnings, errors and the summary")
+	flag.StringVar(&opts.BoshBin, "bosh-bin", getFromEnv("BLOBS_UPGRADER_BOSH_BIN", ""), "bosh binary running the blob commands instead of the embedded bosh CLI (env: BLOBS_UPGRADER_BOSH_BIN)")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "stream the output of bosh commands")
+	flag.BoolVar(&showVersion, "version", false, "print the version and exit")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "report planned upgrades without modifying blobs")
+	flag.BoolVar(&opts.PrintCommands, "print-commands", false, "print the bosh commands modifying and uploading blobs instead of running them, implies -dry-run")
+	flag.BoolVar(&opts.Check, "check", false, "list packages with a newer upstream version without downloading anything")
+	flag.BoolVar(&opts.IncludePrerelease, "include-prerelease", false, "consider pre-release versions like 2.0.0-rc1 of all packages")
+	flag.BoolVar(&opts.AllowDowngrade, "allow-downgrade", false, "upgrade packages to a latest version lower than the current one")
+	flag.BoolVar(&opts.FailFast, "fail-fast", false, "stop at the first failing package instead of checking the remaining ones")
+	flag.BoolVar(&opts.Offline, "offline", false, "add the blob files staged in the package directories without running scripts or downloading, requires pinned versions")
+	flag.BoolVar(&opts.Force, "force", false, "download, add and upload the blobs of all checked packages even if they are unchanged")
+	flag.BoolVar(&opts.Prune, "prune", false, "remove blobs of managed packages which do not match the current metalink files")
+	flag.StringVar(&opts.PrivateConfig, "private-config", getFromEnv("BLOBS_UPGRADER_PRIVATE_CONFIG", ""), "private config with the blobstore credentials used by upload-blobs (env: BLOBS_UPGRADER_PRIVATE_CONFIG) (default: private.yml in the config directory)")
+	flag.BoolVar(&opts.SkipUpload, "skip-upload", false, "add and remove blobs locally without uploading them")
+	flag.BoolVar(&opts.GitCommit, "git-commit", false, "commit blobs.yml and the version files if blobs changed")
+	flag.BoolVar(&opts.GitHubPR, "github-pr", false, "commit the changes on a new branch, push it and open a GitHub pull request (env: GITHUB_TOKEN, GITHUB_REPOSITORY)")
+	flag.StringVar(&opts.GitHubBase, "github-base", getFromEnv("BLOBS_UPGRADER_GITHUB_BASE", ""), "base branch of the pull request of -github-pr (env: BLOBS_UPGRADER_GITHUB_BASE) (default: current branch)")
+	flag.StringVar(&opts.GitAuthor, "git-author", getFromEnv("BLOBS_UPGRADER_GIT_AUTHOR", ""), "author of the commit of -git-commit as 'Name <email>' (env: BLOBS_UPGRADER_GIT_AUTHOR)")
+	flag.BoolVar(&opts.CleanupDownloads, "cleanup-downloads", false, "remove downloaded files from the package directories once bosh added them")
+	flag.IntVar(&opts.KeepDownloads, "keep-downloads", 1, "number of downloaded files of each metalink file kept in the package directory after an upgrade including the current one, 0 keeps all")
+	flag.StringVar(&opts.TmpDir, "tmp-dir", getFromEnv("BLOBS_UPGRADER_TMP_DIR", ""), "directory of in-progress downloads (env: BLOBS_UPGRADER_TMP_DIR) (default: the package directory)")
+	opts.DigestAlgorithm = "sha256"
+	flag.Var(&opts.DigestAlgorithm, "digest-algo", "digest algorithm of new blobs in blobs.yml: sha1, sha256 or sha512")
+	opts.FileMode = 0644
+	flag.Var(&opts.FileMode, "file-mode", "permissions of downloaded blobs")
+	flag.StringVar(&opts.NotifyURL, "notify-url", getFromEnv("BLOBS_UPGRADER_NOTIFY_URL", ""), "webhook receiving the JSON report, or a message if it is a Slack incoming webhook, after a successful run with changes (env: BLOBS_UPGRADER_NOTIFY_URL)")
+	flag.BoolVar(&opts.NotifyAlways, "notify-always", false, "notify the -notify-url also if nothing changed")
+	flag.StringVar(&opts.Changelog, "changelog", "", "append a dated Markdown section listing the upgraded packages to this file")
+	flag.StringVar(&opts.ReportJSON, "report-json", "", "write a JSON report of all checked packages to this file, or to stdout if '-'")
+	flag.StringVar(&opts.MetricsFile, "metrics-file", "", "write Prometheus metrics of the run in the text format to this file")
+	flag.Var(&opts.Only, "only", "comma-separated list of packages to upgrade")
+	flag.StringVar(&packagesFile, "packages-file", "", "file listing packages to upgrade, one per line, in addition to -only")
+	flag.Var(&opts.Mirrors, "mirror", "comma-separated host=URL pairs of mirrors preferred over the hosts of metalink URLs")
+	flag.Var(&opts.MaxSize, "max-size", "maximum size of a downloaded blob, e.g. 2G (default: unlimited)")
+	flag.Var(&opts.RateLimit, "rate-limit", "maximum aggregate download rate per second, e.g. 10M (default: unlimited)")
+	flag.IntVar(&opts.Retries, "retries", 3, "number of retries of failed downloads")
+	flag.BoolVar(&opts.SkipContentCheck, "skip-content-check", false, "accept downloads which look like HTML pages")
+	flag.IntVar(&opts.MaxRedirects, "max-redirects", 10, "maximum number of redirects followed by a download")
+	flag.DurationVar(&opts.VersionCacheTTL, "version-cache-ttl", 0, "reuse the output of version_check scripts for this duration, e.g. 1h (default: no caching)")
+	flag.BoolVar(&opts.NoCache, "no-cache", false, "ignore cached versions and run all version_check scripts")
+	flag.IntVar(&opts.CheckWorkers, "version-check-workers", 4, "number of version_check scripts run concurrently before downloading")
+	flag.DurationVar(&opts.ScriptTimeout, "script-timeout", 10*time.Minute, "timeout of a version_check or metalink_get script, 0 disables it")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "timeout of the whole run, e.g. 30m (default: no timeout)")
+	flag.DurationVar(&opts.LockTimeout, "lock-timeout", 0, "time to wait for another run in the release directory to finish (default: fail immediately)")
+	flag.DurationVar(&opts.HTTPTimeout, "http-timeout", httpTimeout, "timeout of a single download (env: BLOBS_UPGRADER_HTTP_TIMEOUT)")
+	flag.Parse()
+
+	if showVersion {
+		fmt.Println(buildVersion)
+		return
 	}
 
-	for _, r := range resourcePaths {
-		localBlobDir := filepath.Dir(r)
-		packageName := filepath.Base(localBlobDir)
-		repositoryBytes, err := ioutil.ReadFile(r)
-		if err != nil {
-			panic(err)
+	// release dirs given both as -dir and argument are only upgraded once
+	seen := map[string]bool{}
+	var dirs []string
+	for _, dir := range append(releaseDirs, flag.Args()...) {
+		if !seen[filepath.Clean(dir)] {
+			seen[filepath.Clean(dir)] = true
+			dirs = append(dirs, dir)
 		}
+	}
 
-		var resourceConfig ResourceConfig
-		err = yaml.Unmarshal(repositoryBytes, &resourceConfig)
+	if len(dirs) == 0 {
+		wd, err := os.Getwd()
 		if err != nil {
-			panic(err)
+			errorf("determining working directory: %v", err)
+			os.Exit(1)
 		}
+		dirs = append(dirs, wd)
+	}
 
-		stdout, err := api.ExecuteScript(resourceConfig.Source.VersionCheck, nil)
-		if err != nil {
-			panic(err)
-		}
-		versionsList := strings.Split(strings.TrimSpace(string(stdout)), "\n")
-		latestVersion, err := version.NewVersion(versionsList[0])
-		for i, rawVersion := range versionsList {
-			if rawVersion == "" || i == 0 {
-				continue
-			}
-			v, _ := version.NewVersion(rawVersion)
-			if latestVersion.LessThan(v) {
-				latestVersion = v
-			}
+	// the config file of several releases is looked up in the working
+	// directory, e.g. the root of a monorepo
+	configRequired := configPath != ""
+	if !configRequired {
+		configPath = configFileName
+		if len(dirs) == 1 {
+			configPath = filepath.Join(dirs[0], configFileName)
 		}
+	}
+	err = loadConfigFile(flag.CommandLine, configPath, configRequired)
+	if err != nil {
+		errorf("%v", err)
+		os.Exit(1)
+	}
 
-		meta4Bytes, err := api.ExecuteScript(resourceConfig.Source.MetalinkGet, map[string]string{
-			"version": latestVersion.Original(),
-		})
+	if packagesFile != "" {
+		packageNames, err := readPackagesFile(packagesFile)
 		if err != nil {
-			errors.Wrap(err, "executing metalink_get script")
+			errorf("%v", err)
+			os.Exit(1)
 		}
-		var meta4 metalink.Metalink
-		err = metalink.Unmarshal(meta4Bytes, &meta4)
-		if err != nil {
-			errors.Wrap(err, "unmarshaling metalinks")
-		}
-
-		if len(meta4.Files) > 1 {
-			panic("more than one metalink file is currently not supported.")
-		}
-		file := meta4.Files[0]
-		if len(file.URLs) > 1 {
-			panic("more than one metalink URL per file is currently not supported.")
-		}
-
-		versionPath := filepath.Join(localBlobDir, "version")
+		opts.Only = append(opts.Only, packageNames...)
+	}
 
-		currentVersionBytes, err := ioutil.ReadFile(versionPath)
-		if err != nil && !os.IsNotExist(err) {
-			panic(err)
-		}
+	// nothing is modified if the bosh commands are only printed
+	if opts.PrintCommands {
+		opts.DryRun = true
+	}
 
-		if string(currentVersionBytes) == latestVersion.Original() {
-			fmt.Printf("Skipping  package '%s'. Version is unchanged.\n", packageName)
-			continue
+	// only warnings, errors and the summary are printed in quiet mode
+	if opts.Quiet {
+		if currentLogLevel < levelWarn {
+			currentLogLevel = levelWarn
 		}
+		opts.Progress = false
+	}
 
-		// compare latest upstream version with version from blobs.yml
-		blobFilePath := filepath.Join(localBlobDir, file.Name)
-		for _, b := range blobs {
-
-			if b.PackageName != packageName {
-				continue
-			}
-			fmt.Printf("Checking %s (%s)\n", b.Path, b.Sha)
+	colorEnabled = color.enabled(os.Stdout)
 
-			var newBlob Blob
-			newBlob, err = DownloadFile(blobFilePath, file.URLs[0].URL)
-			if err != nil {
-				panic(err)
-			}
+	if len(opts.InsecureHosts) > 0 {
+		warnf("TLS certificates of downloads from %s are NOT verified.", strings.Join(opts.InsecureHosts, ", "))
+	} else if opts.Insecure {
+		warnf("TLS certificates of all downloads are NOT verified.")
+	}
 
-			if b.Sha == newBlob.Sha {
-				fmt.Printf("Skipping package '%s'. Blobs digest '%s' did not change.\n", b.PackageName, newBlob.Sha)
-				continue
-			}
+	// keep stdout parseable if the JSON report is written to it
+	summaryOutput := io.Writer(os.Stdout)
+	if opts.ReportJSON == "-" {
+		logOutput = os.Stderr
+		summaryOutput = os.Stderr
+		if opts.Quiet {
+			summaryOutput = ioutil.Discard
+		}
+	}
 
-			newBlob.Path = fmt.Sprintf("%s/%s", packageName, file.Name)
-			fmt.Printf("Upgrading blob: %s (%s) --> %s (%s)\n", b.Path, b.Sha, newBlob.Path, newBlob.Sha)
+	ctx, cancel := signalContext()
+	defer cancel()
 
-			err = boshRemoveBlob(b.Path, releaseDir)
-			if err != nil {
-				panic(errors.Wrap(err, "removing old blobs"))
-			}
+	// the run is cancelled like on a signal once the timeout fires, which
+	// removes partial downloads and temporary files
+	if opts.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, opts.Timeout)
+		defer cancelTimeout()
+	}
 
-			err = boshAddBlob(blobFilePath, newBlob.Path, releaseDir)
-			if err != nil {
-				panic(errors.Wrap(err, "adding new blobs"))
-			}
+	start := time.Now()
+	report, err := runReleases(ctx, dirs, opts)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("run timed out after %s", opts.Timeout)
+	}
+	if opts.Check {
+		report.PrintCheck(summaryOutput)
+	} else {
+		report.Print(summaryOutput)
+	}
+	if opts.ReportJSON != "" {
+		reportErr := report.WriteJSON(opts.ReportJSON)
+		if reportErr != nil && err == nil {
+			err = errors.Wrap(reportErr, "writing JSON report")
 		}
-
-		err = ioutil.WriteFile(versionPath, []byte(latestVersion.Original()), 0755)
-		if err != nil && !os.IsNotExist(err) {
-			panic(errors.Wrap(err, "writing version"))
+	}
+	if opts.MetricsFile != "" {
+		metricsErr := report.WriteMetrics(opts.MetricsFile, time.Since(start), err == nil, time.Now())
+		if metricsErr != nil && err == nil {
+			err = errors.Wrap(metricsErr, "writing metrics")
 		}
 	}
-
-	if _, err := os.Stat(filepath.Join(releaseDir, "config", "private.yml")); os.IsNotExist(err) {
-		panic(fmt.Errorf("blobstore credentials not set: %v", err))
+	if err == nil && opts.NotifyURL != "" && (report.Changed() || opts.NotifyAlways) {
+		notifyErr := notify(ctx, opts.NotifyURL, report)
+		if notifyErr != nil {
+			warnf("sending notification: %v", notifyErr)
+		}
 	}
-
-	err = boshUploadBlobs(releaseDir)
 	if err != nil {
-		panic(errors.Wrap(err, "uploading blobs"))
+		if debug {
+			errorf("%+v", err)
+		} else {
+			errorf("%v", err)
+		}
+		os.Exit(1)
+	}
+
+	if !report.Changed() {
+		return
+	}
+	if opts.DryRun || opts.Check {
+		os.Exit(exitChangesPending)
 	}
+	os.Exit(exitChangesApplied)
 }
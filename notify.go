@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// notifyTimeout is the timeout of posting a notification.
+const notifyTimeout = 30 * time.Second
+
+// isSlackWebhook reports whether the url is a Slack incoming webhook, which
+// expects a text message instead of the JSON report.
+func isSlackWebhook(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(u.Hostname(), "hooks.slack.com")
+}
+
+// slackMessage returns the Slack message of the run, listing the upgraded and
+// failed packages.
+func slackMessage(report *summary) ([]byte, error) {
+	counts := map[string]int{}
+	for _, r := range report.Results {
+		counts[r.Action]++
+	}
+
+	lines := []string{fmt.Sprintf("*bosh-blobs-upgrader*: %d checked, %d upgraded, %d failed",
+		report.checked(), counts[actionUpgraded], counts[actionFailed])}
+	for _, r := range report.Results {
+		switch {
+		case r.Action == actionUpgraded || r.Action == actionOutdated:
+			oldVersion := r.OldVersion
+			if oldVersion == "" {
+				oldVersion = "-"
+			}
+			lines = append(lines, fmt.Sprintf("• `%s` %s → %s (%s)", r.name(), oldVersion, r.NewVersion, r.Action))
+		case r.Action == actionFailed:
+			lines = append(lines, fmt.Sprintf("• `%s` failed: %s", r.name(), r.Error))
+		}
+		if len(r.Pruned) > 0 {
+			lines = append(lines, fmt.Sprintf("• `%s` pruned %s", r.name(), strings.Join(r.Pruned, ", ")))
+		}
+	}
+
+	return json.Marshal(map[string]string{"text": strings.Join(lines, "\n")})
+}
+
+// notify posts the JSON report of the run to the webhook, or a text message
+// to a Slack incoming webhook.
+func notify(ctx context.Context, webhookURL string, report *summary) error {
+	payload, err := report.JSON()
+	if isSlackWebhook(webhookURL) {
+		payload, err = slackMessage(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errorBodyLimit))
+		return fmt.Errorf("unexpected response '%s': %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpb587/metalink"
+	"github.com/pkg/errors"
+)
+
+// errOffline is returned by network requests in offline mode.
+var errOffline = errors.New("network access is disabled by -offline")
+
+// offlineDownloader uses the blob files staged in the package directories
+// instead of downloading them. The files are hashed and verified against the
+// metalink like downloads.
+type offlineDownloader struct {
+	Digest string
+}
+
+func (d offlineDownloader) Download(ctx context.Context, filePath string, file metalink.File) (Blob, int64, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return Blob{}, 0, fmt.Errorf("staged file '%s' is missing (copy it to '%s' before running with -offline)", file.Name, filepath.Dir(filePath))
+	}
+	if err != nil {
+		return Blob{}, 0, err
+	}
+
+	if file.Size > 0 && uint64(info.Size()) != file.Size {
+		return Blob{}, 0, fmt.Errorf("verifying staged file '%s': size mismatch: expected %d bytes, got %d", file.Name, file.Size, info.Size())
+	}
+
+	infof("Hashing staged file %s", filePath)
+	hashes, hashers := newDigestHashes()
+	err = hashFile(filePath, io.MultiWriter(hashers...))
+	if err != nil {
+		return Blob{}, 0, errors.Wrapf(err, "hashing staged file '%s'", file.Name)
+	}
+
+	blob := Blob{digests: sumDigests(hashes)}
+
+	if expected, ok := strongestHash(file.Hashes); ok {
+		actual := blob.digests[metalinkAlgorithm(expected.Type)]
+		if actual != strings.ToLower(strings.TrimSpace(expected.Hash)) {
+			return Blob{}, 0, fmt.Errorf("verifying staged file '%s': %s digest mismatch: expected '%s', got '%s'", file.Name, expected.Type, expected.Hash, actual)
+		}
+	}
+
+	blob.Sha = formatDigest(d.Digest, blob.digests[d.Digest])
+	return blob, 0, nil
+}
+
+func (d offlineDownloader) Get(ctx context.Context, url string) ([]byte, error) {
+	return nil, errOffline
+}
+
+func (d offlineDownloader) Stat(ctx context.Context, file metalink.File) (remoteValidators, error) {
+	return remoteValidators{}, errOffline
+}
+
+// offlineFiles returns the files replacing the blobs of the package in
+// offline mode without a metalink_file. The name of each blob with the old
+// version replaced by the new version is expected to be staged in the
+// package directory.
+func offlineFiles(packageName string, blobs []*Blob, oldVersion string, v *taggedVersion) ([]metalink.File, error) {
+	if len(blobs) == 0 {
+		return nil, fmt.Errorf("cannot determine the files of package '%s' without blobs in blobs.yml or a 'source.metalink_file' in -offline mode", packageName)
+	}
+
+	var files []metalink.File
+	seen := map[string]bool{}
+	for _, b := range blobs {
+		name := path.Base(b.Path)
+		if oldVersion := strings.TrimSpace(oldVersion); oldVersion != "" {
+			name = strings.Replace(name, oldVersion, v.Original(), -1)
+		}
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, metalink.File{Name: name})
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/dpb587/metalink"
+)
+
+// platformAliases maps common spellings of operating systems and
+// architectures in metalink os hints to their Go names.
+var platformAliases = map[string]string{
+	"macos":   "darwin",
+	"osx":     "darwin",
+	"mac":     "darwin",
+	"x86_64":  "amd64",
+	"x64":     "amd64",
+	"aarch64": "arm64",
+	"i386":    "386",
+	"i686":    "386",
+	"x86":     "386",
+}
+
+// knownArchs are the architectures recognized in metalink os hints. Files
+// without any of them match all architectures.
+var knownArchs = map[string]bool{
+	"amd64":   true,
+	"arm64":   true,
+	"386":     true,
+	"arm":     true,
+	"ppc64le": true,
+	"s390x":   true,
+	"riscv64": true,
+}
+
+// platform is the target os and arch of the downloaded metalink files.
+type platform struct {
+	OS   string
+	Arch string
+}
+
+// targetPlatform returns the os and arch declared by the source, defaulting
+// to those of the host.
+func (s Source) targetPlatform() platform {
+	p := platform{OS: normalizePlatform(s.OS), Arch: normalizePlatform(s.Arch)}
+	if p.OS == "" {
+		p.OS = runtime.GOOS
+	}
+	if p.Arch == "" {
+		p.Arch = runtime.GOARCH
+	}
+
+	return p
+}
+
+func (p platform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+// matches reports whether the os hints of the file, e.g. "linux-x86_64" or
+// "linux" and "amd64", name the os and arch of the platform.
+func (p platform) matches(file metalink.File) bool {
+	var matchedOS, matchedArch, hasArch bool
+	for _, hint := range file.OS {
+		for _, token := range strings.FieldsFunc(hint, func(r rune) bool {
+			return r == '-' || r == '/' || r == ' ' || r == '.'
+		}) {
+			token = normalizePlatform(token)
+			if token == p.OS {
+				matchedOS = true
+			}
+			if knownArchs[token] {
+				hasArch = true
+				if token == p.Arch {
+					matchedArch = true
+				}
+			}
+		}
+	}
+
+	return matchedOS && (matchedArch || !hasArch)
+}
+
+// selectPlatformFiles returns the files matching the platform. The files are
+// returned unchanged if none of them carries os hints.
+func selectPlatformFiles(files []metalink.File, p platform) []metalink.File {
+	var hinted bool
+	for _, file := range files {
+		if len(file.OS) > 0 {
+			hinted = true
+			break
+		}
+	}
+	if !hinted {
+		return files
+	}
+
+	var selected []metalink.File
+	for _, file := range files {
+		if p.matches(file) {
+			selected = append(selected, file)
+		}
+	}
+
+	return selected
+}
+
+func normalizePlatform(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if alias, ok := platformAliases[s]; ok {
+		return alias
+	}
+
+	return s
+}
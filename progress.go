@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressInterval is the minimum delay between two progress updates.
+const progressInterval = time.Second
+
+// isTerminal reports whether the file is a character device like a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressReader periodically prints how much of the underlying reader has
+// been read. A total of zero means the size is unknown.
+type progressReader struct {
+	reader  io.Reader
+	out     io.Writer
+	total   int64
+	read    int64
+	start   time.Time
+	printed time.Time
+}
+
+func newProgressReader(reader io.Reader, total int64, out io.Writer) *progressReader {
+	now := time.Now()
+	return &progressReader{reader: reader, out: out, total: total, start: now, printed: now}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+
+	if now := time.Now(); now.Sub(p.printed) >= progressInterval {
+		p.printed = now
+		p.print(now)
+	}
+
+	return n, err
+}
+
+// Finish prints the final progress and terminates the progress line.
+func (p *progressReader) Finish() {
+	p.print(time.Now())
+	fmt.Fprintln(p.out)
+}
+
+func (p *progressReader) print(now time.Time) {
+	var rate int64
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = int64(float64(p.read) / elapsed)
+	}
+
+	if p.total > 0 {
+		fmt.Fprintf(p.out, "\r  %s / %s (%d%%) %s/s ", formatBytes(p.read), formatBytes(p.total), p.read*100/p.total, formatBytes(rate))
+	} else {
+		fmt.Fprintf(p.out, "\r  %s %s/s ", formatBytes(p.read), formatBytes(rate))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Actions recorded in package results.
+const (
+	actionUpgraded  = "upgraded"
+	actionUnchanged = "unchanged"
+	actionPinned    = "pinned"
+	actionOutdated  = "outdated"
+	actionFailed    = "failed"
+	actionSkipped   = "skipped"
+)
+
+// Reasons for not upgrading a package recorded in package results.
+const (
+	skipVersionUnchanged = "version unchanged"
+	skipPinned           = "pinned version unchanged"
+	skipDowngrade        = "latest version is lower"
+	skipBlobsUnchanged   = "blobs unchanged"
+	skipNotSelected      = "not selected by -only"
+	skipFailed           = "failed"
+)
+
+// packageResult records the outcome of checking a package.
+type packageResult struct {
+	Release    string   `json:"release,omitempty"`
+	Package    string   `json:"package"`
+	Action     string   `json:"action"`
+	OldVersion string   `json:"old_version"`
+	NewVersion string   `json:"new_version"`
+	OldSha     string   `json:"old_sha"`
+	NewSha     string   `json:"new_sha"`
+	Bytes      int64    `json:"bytes_downloaded"`
+	Seconds    float64  `json:"download_seconds"`
+	Pruned     []string `json:"pruned,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	SkipReason string   `json:"skip_reason,omitempty"`
+
+	// versionFile is written with the new version after the blobs were
+	// uploaded; empty if there is nothing to write.
+	versionFile string
+	// validators of the metalink files without digest are written next to
+	// the version file.
+	validators map[string]remoteValidators
+}
+
+// addOldSha records the digest of a replaced blob. The digests of several
+// replaced blobs are separated by commas in the order of the changes.
+func (r *packageResult) addOldSha(sha string) {
+	for _, old := range strings.Split(r.OldSha, ",") {
+		if old == sha {
+			return
+		}
+	}
+	if r.OldSha != "" {
+		r.OldSha += ","
+	}
+	r.OldSha += sha
+}
+
+// summary accumulates the package results of a run.
+type summary struct {
+	Results []*packageResult
+}
+
+// name returns the package name, prefixed with the release if several
+// releases were upgraded.
+func (r *packageResult) name() string {
+	if r.Release == "" {
+		return r.Package
+	}
+	return r.Release + "/" + r.Package
+}
+
+// skip records why the package was not upgraded and logs it.
+func (r *packageResult) skip(reason string) {
+	r.SkipReason = reason
+	infof("skip: %s (%s)", r.Package, reason)
+}
+
+func (s *summary) add(packageName string) *packageResult {
+	result := &packageResult{Package: packageName, Action: actionUnchanged}
+	s.Results = append(s.Results, result)
+	return result
+}
+
+// checked returns the number of packages which were not skipped by -only.
+func (s *summary) checked() int {
+	n := 0
+	for _, r := range s.Results {
+		if r.Action != actionSkipped {
+			n++
+		}
+	}
+	return n
+}
+
+// Changed reports whether any package was upgraded, pruned or is outdated.
+func (s *summary) Changed() bool {
+	for _, r := range s.Results {
+		if r.Action == actionUpgraded || r.Action == actionOutdated || len(r.Pruned) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes a human readable summary of the run.
+func (s *summary) Print(w io.Writer) {
+	counts := map[string]int{}
+	var bytes int64
+	var seconds float64
+	for _, r := range s.Results {
+		counts[r.Action]++
+		bytes += r.Bytes
+		seconds += r.Seconds
+	}
+
+	count := func(action string) string {
+		text := fmt.Sprintf("%d %s", counts[action], action)
+		if counts[action] == 0 {
+			return text
+		}
+		return colorize(actionColor(action), text)
+	}
+	fmt.Fprintf(w, "\nSummary: %d checked, %s, %s, %s, %s, %s downloaded in %s\n",
+		s.checked(), count(actionUpgraded), count(actionUnchanged), count(actionPinned), count(actionFailed), formatBytes(bytes), formatSeconds(seconds))
+
+	var pruned []string
+	for _, r := range s.Results {
+		pruned = append(pruned, r.Pruned...)
+	}
+	if len(pruned) > 0 {
+		fmt.Fprintf(w, "Pruned %d stale blobs: %s\n", len(pruned), strings.Join(pruned, ", "))
+	}
+
+	var skipped []string
+	for _, r := range s.Results {
+		if r.SkipReason != "" {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", r.name(), r.SkipReason))
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "Skipped %d packages: %s\n", len(skipped), strings.Join(skipped, ", "))
+	}
+
+	// packages which downloaded without being upgraded are listed as well,
+	// since they used the bandwidth all the same
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, r := range s.Results {
+		if r.Action != actionUpgraded && r.Bytes == 0 {
+			continue
+		}
+		oldVersion := r.OldVersion
+		if oldVersion == "" {
+			oldVersion = "-"
+		}
+		change := fmt.Sprintf("%s -> %s", oldVersion, r.NewVersion)
+		if r.Action != actionUpgraded {
+			change = fmt.Sprintf("%s (%s)", r.NewVersion, r.Action)
+		}
+		// every row is wrapped in the same color, which keeps the columns
+		// aligned
+		fmt.Fprintln(tw, colorize(actionColor(r.Action), fmt.Sprintf("  %s\t%s\t%s\tin %s", r.name(), change, formatBytes(r.Bytes), formatSeconds(r.Seconds))))
+	}
+	tw.Flush()
+}
+
+// formatSeconds formats a duration in seconds for the summary.
+func formatSeconds(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// PrintCheck writes a table of the current and available version of all
+// checked packages.
+func (s *summary) PrintCheck(w io.Writer) {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tCURRENT\tAVAILABLE\tSTATUS")
+	for _, r := range s.Results {
+		current, available := r.OldVersion, r.NewVersion
+		if current == "" {
+			current = "-"
+		}
+		if available == "" {
+			available = "-"
+		}
+		// only the last column is colored, so that the escape sequences do
+		// not disturb the alignment
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.name(), current, available, colorize(actionColor(r.Action), r.Action))
+	}
+	tw.Flush()
+}
+
+// JSON returns the package results as a JSON array.
+func (s *summary) JSON() ([]byte, error) {
+	results := s.Results
+	if results == nil {
+		results = []*packageResult{}
+	}
+
+	return json.MarshalIndent(results, "", "  ")
+}
+
+// WriteJSON writes the package results as a JSON array to the file, or to
+// stdout if the path is "-".
+func (s *summary) WriteJSON(path string) error {
+	data, err := s.JSON()
+	if err != nil {
+		return err
+	}
+
+	if path == "-" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// WriteMetrics writes the metrics of the run in the Prometheus text format to
+// the file, e.g. for the textfile collector of the node exporter. The file is
+// replaced atomically, so that it is never scraped half-written.
+func (s *summary) WriteMetrics(path string, duration time.Duration, success bool, now time.Time) error {
+	counts := map[string]int{}
+	var bytes int64
+	for _, r := range s.Results {
+		counts[r.Action]++
+		bytes += r.Bytes
+	}
+
+	successValue := 0
+	if success {
+		successValue = 1
+	}
+
+	metrics := []struct {
+		name, help, kind string
+		value            interface{}
+	}{
+		{"packages_checked_total", "Packages checked by the run.", "counter", s.checked()},
+		{"packages_upgraded_total", "Packages upgraded by the run.", "counter", counts[actionUpgraded]},
+		{"packages_failed_total", "Packages which failed in the run.", "counter", counts[actionFailed]},
+		{"downloaded_bytes", "Bytes downloaded by the run.", "gauge", bytes},
+		{"run_duration_seconds", "Duration of the run.", "gauge", duration.Seconds()},
+		{"run_success", "Whether the run succeeded.", "gauge", successValue},
+		{"run_timestamp_seconds", "Time the run finished.", "gauge", now.Unix()},
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		name := "blobs_upgrader_" + m.name
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, m.help, name, m.kind, name, m.value)
+	}
+
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+// AppendChangelog appends a Markdown section of the date listing the upgraded
+// packages to the file, so that the history accumulates across runs. Nothing
+// is written if no package was upgraded.
+func (s *summary) AppendChangelog(path string, date time.Time) error {
+	var b strings.Builder
+	for _, r := range s.Results {
+		if r.Action != actionUpgraded {
+			continue
+		}
+		oldVersion := r.OldVersion
+		if oldVersion == "" {
+			oldVersion = "-"
+		}
+		fmt.Fprintf(&b, "- `%s`: %s -> %s (`%s`)\n", r.name(), oldVersion, r.NewVersion, r.NewSha)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	separator := ""
+	if info.Size() > 0 {
+		separator = "\n"
+	}
+
+	_, err = fmt.Fprintf(f, "%s## %s\n\n%s", separator, date.Format("2006-01-02"), b.String())
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
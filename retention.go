@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dpb587/metalink"
+)
+
+// versionPattern matches the versions in the names of downloaded files.
+const versionPattern = `v?[0-9][0-9A-Za-z.+~-]*`
+
+// downloadPattern returns the pattern matching the name of the file with any
+// version in place of the given one. It reports false if the name does not
+// contain the version.
+func downloadPattern(name, version string) (*regexp.Regexp, bool) {
+	i := strings.Index(name, version)
+	if version == "" || i < 0 {
+		return nil, false
+	}
+	prefix, suffix := name[:i], name[i+len(version):]
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + versionPattern + regexp.QuoteMeta(suffix) + "$"), true
+}
+
+// downloadedFiles returns the metalink files and the output files of the
+// post_download hook added by the changes, which are current downloads as
+// well.
+func downloadedFiles(files []metalink.File, changes []blobChange) []metalink.File {
+	downloaded := append([]metalink.File(nil), files...)
+	seen := map[string]bool{}
+	for _, file := range files {
+		seen[file.Name] = true
+	}
+	for _, c := range changes {
+		name := filepath.Base(c.FilePath)
+		if !seen[name] {
+			seen[name] = true
+			downloaded = append(downloaded, metalink.File{Name: name})
+		}
+	}
+	return downloaded
+}
+
+// pruneDownloads removes the downloaded files of older versions of the
+// metalink files from the package directory. For each file, the keep most
+// recently modified files of any version are kept, including the current
+// one. Files of the current version are never removed.
+func pruneDownloads(localBlobDir string, files []metalink.File, version string, keep int) error {
+	entries, err := ioutil.ReadDir(localBlobDir)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, file := range files {
+		current[file.Name] = true
+	}
+
+	for _, file := range files {
+		pattern, ok := downloadPattern(file.Name, version)
+		if !ok {
+			continue
+		}
+
+		var previous []os.FileInfo
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !current[entry.Name()] && pattern.MatchString(entry.Name()) {
+				previous = append(previous, entry)
+			}
+		}
+		sort.Slice(previous, func(i, j int) bool {
+			return previous[i].ModTime().After(previous[j].ModTime())
+		})
+
+		// the current file counts towards the kept files
+		for i, entry := range previous {
+			if i < keep-1 {
+				continue
+			}
+			infof("Removing old download: %s", entry.Name())
+			err = os.Remove(filepath.Join(localBlobDir, entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scriptWaitDelay is the time to wait for the output of a killed script to be
+// closed, e.g. by processes the script started in the background.
+const scriptWaitDelay = 5 * time.Second
+
+// runScript executes the script like api.ExecuteScript, but kills it once the
+// context is done or the timeout expires. A timeout of zero disables it.
+func runScript(ctx context.Context, timeout time.Duration, script string, env map[string]string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stdout, err := executeScript(ctx, script, env)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return stdout, err
+}
+
+// executeScript writes the script to a temporary file and runs it with the
+// environment merged into the current one.
+func executeScript(ctx context.Context, script string, env map[string]string) ([]byte, error) {
+	tmpfile, err := ioutil.TempFile("", "live-metalink")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating script")
+	}
+
+	defer os.RemoveAll(tmpfile.Name())
+
+	err = tmpfile.Chmod(0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "chmoding script")
+	}
+
+	if len(script) < 2 || script[0:2] != "#!" {
+		script = fmt.Sprintf("#!/bin/bash -eu\n\n%s", script)
+	}
+
+	_, err = tmpfile.WriteString(script)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing script")
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "closing script")
+	}
+
+	stdout := bytes.NewBuffer(nil)
+
+	cmd := exec.CommandContext(ctx, tmpfile.Name())
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = mergedEnv(env)
+	cmd.WaitDelay = scriptWaitDelay
+
+	err = cmd.Run()
+	if err != nil {
+		return nil, errors.Wrap(err, "running script")
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func mergedEnv(env map[string]string) []string {
+	var merged []string
+
+	for k, v := range env {
+		merged = append(merged, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	for _, s := range os.Environ() {
+		if _, found := env[strings.SplitN(s, "=", 2)[0]]; found {
+			continue
+		}
+
+		merged = append(merged, s)
+	}
+
+	return merged
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpb587/metalink"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// armorPrefix starts ASCII-armored keys and signatures.
+const armorPrefix = "-----BEGIN "
+
+// signatureVerifier verifies detached GPG signatures of downloaded files.
+type signatureVerifier struct {
+	Keyring    openpgp.EntityList
+	URL        string
+	Version    *taggedVersion
+	Downloader Downloader
+}
+
+// newSignatureVerifier returns a verifier for the signature_key of the
+// source, or nil if signatures are not verified.
+func newSignatureVerifier(source Source, localBlobDir string, version *taggedVersion, downloader Downloader) (*signatureVerifier, error) {
+	if source.SignatureKey == "" {
+		return nil, nil
+	}
+
+	keyData := []byte(source.SignatureKey)
+	if !strings.HasPrefix(strings.TrimSpace(source.SignatureKey), armorPrefix) {
+		keyPath := source.SignatureKey
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(localBlobDir, keyPath)
+		}
+		var err error
+		keyData, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading signature_key")
+		}
+	}
+
+	var (
+		keyring openpgp.EntityList
+		err     error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(keyData), []byte(armorPrefix)) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing signature_key")
+	}
+
+	return &signatureVerifier{
+		Keyring:    keyring,
+		URL:        source.SignatureURL,
+		Version:    version,
+		Downloader: downloader,
+	}, nil
+}
+
+// signature returns the signature of the metalink file from the signature_url
+// or, without URL, from the signature element of the metalink.
+func (v *signatureVerifier) signature(ctx context.Context, file metalink.File) ([]byte, error) {
+	if v.URL != "" {
+		url := strings.Replace(expandVersion(v.URL, v.Version), "${file}", file.Name, -1)
+		sig, err := v.Downloader.Get(ctx, url)
+		if err != nil {
+			return nil, errors.Wrapf(err, "downloading signature '%s'", url)
+		}
+		return sig, nil
+	}
+
+	if file.Signature == nil || strings.TrimSpace(file.Signature.Signature) == "" {
+		return nil, fmt.Errorf("missing signature of metalink file '%s' (configure a signature_url)", file.Name)
+	}
+	return []byte(strings.TrimSpace(file.Signature.Signature)), nil
+}
+
+// Verify checks the detached signature of the downloaded metalink file.
+func (v *signatureVerifier) Verify(ctx context.Context, filePath string, file metalink.File) error {
+	sig, err := v.signature(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var signer *openpgp.Entity
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(armorPrefix)) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(v.Keyring, f, bytes.NewReader(sig))
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(v.Keyring, f, bytes.NewReader(sig))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "verifying signature of '%s'", file.Name)
+	}
+
+	for name := range signer.Identities {
+		infof("Verified signature of %s by %s", file.Name, name)
+		break
+	}
+	return nil
+}
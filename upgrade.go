@@ -0,0 +1,778 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dpb587/metalink"
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// diskSpaceMargin is the space which has to remain available after a download
+// of the declared size of a metalink file.
+const diskSpaceMargin = 64 << 20
+
+// selectFiles returns the metalink files matching the os hints of the target
+// platform and the glob filter of the source. Files are selected by platform
+// if the source declares an os or arch, or if the metalink contains multiple
+// files and there is no filter. Without a filter, exactly one file must
+// remain.
+func selectFiles(files []metalink.File, source Source) ([]metalink.File, error) {
+	if source.OS != "" || source.Arch != "" || (source.FileFilter == "" && len(files) > 1) {
+		p := source.targetPlatform()
+		files = selectPlatformFiles(files, p)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no metalink file matches os/arch '%s'", p)
+		}
+	}
+
+	filter := source.FileFilter
+	if filter == "" {
+		if len(files) != 1 {
+			return nil, fmt.Errorf("expected exactly one metalink file, got %d (configure a file_filter or os/arch to select files)", len(files))
+		}
+		return files, nil
+	}
+
+	var selected []metalink.File
+	for _, file := range files {
+		matched, err := filepath.Match(filter, file.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "matching file_filter '%s'", filter)
+		}
+		if matched {
+			selected = append(selected, file)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no metalink file matches file_filter '%s'", filter)
+	}
+
+	return selected, nil
+}
+
+// blobChange replaces the Old blob with the New blob downloaded to FilePath.
+// Old is nil if the blob is added. DownloadPath is the download if the
+// post_download hook wrote the FilePath to another file.
+type blobChange struct {
+	FilePath     string
+	DownloadPath string
+	Old          *Blob
+	New          Blob
+}
+
+// planFile downloads the metalink file if it differs from the given blobs and
+// returns the changes replacing them with it. The file is added as a new blob
+// if there are no blobs to replace. With -force, unchanged blobs are replaced
+// as well. Files without a digest comparable with the blobs are not
+// downloaded if their validators match the cached ones of the previous
+// download. The post_download hook runs on the verified download and its
+// output file replaces the blobs.
+func (u *Upgrader) planFile(ctx context.Context, verifier *signatureVerifier, hook *postDownloadHook, packageName, localBlobDir string, file metalink.File, blobs []*Blob, cached map[string]remoteValidators, result *packageResult) ([]blobChange, error) {
+	if len(file.URLs) == 0 && !u.Options.Offline {
+		return nil, fmt.Errorf("metalink file '%s' of package '%s' contains no URLs", file.Name, packageName)
+	}
+
+	// compare latest upstream version with version from blobs.yml
+	// the digests are compared with the strongest hash of the metalink
+	// using the same algorithm
+	var outdated []*Blob
+	sums := metalinkDigests(file.Hashes)
+	comparable := false
+	for _, b := range blobs {
+		infof("Checking %s (%s)", b.Path, b.Sha)
+
+		equal, ok := compareDigests(parseDigest(b.Sha), sums)
+		comparable = comparable || ok
+		if equal && !u.Options.Force {
+			infof("Unchanged blob: %s (%s)", b.Path, b.Sha)
+			continue
+		}
+		outdated = append(outdated, b)
+	}
+
+	if len(blobs) > 0 && len(outdated) == 0 {
+		return nil, nil
+	}
+
+	if !comparable && len(blobs) > 0 && !u.Options.Force {
+		unchanged, err := u.checkValidators(ctx, packageName, file, outdated, cached, result)
+		if err != nil {
+			return nil, err
+		}
+		if unchanged {
+			infof("Unchanged blobs: validators of '%s' of package '%s' did not change", file.Name, packageName)
+			return nil, nil
+		}
+	}
+
+	err := u.checkMaxSize(ctx, packageName, file)
+	if err != nil {
+		return nil, err
+	}
+
+	// fail early instead of with a write error in the middle of the download
+	dirs := []string{localBlobDir}
+	if u.Options.TmpDir != "" && !u.Options.Offline {
+		dirs = append(dirs, u.Options.TmpDir)
+	}
+	for _, dir := range dirs {
+		if free, ok := freeSpace(dir); ok && file.Size > 0 && free < file.Size+diskSpaceMargin {
+			return nil, fmt.Errorf("insufficient disk space for package '%s': downloading '%s' requires %s including a margin, only %s available in '%s'",
+				packageName, file.Name, formatBytes(int64(file.Size+diskSpaceMargin)), formatBytes(int64(free)), dir)
+		}
+	}
+
+	downloadPath := filepath.Join(localBlobDir, file.Name)
+	blobFilePath := downloadPath
+	start := u.Clock.Now()
+	newBlob, n, err := u.Downloader.Download(ctx, blobFilePath, file)
+	result.Bytes += n
+	result.Seconds += u.Clock.Now().Sub(start).Seconds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "downloading blob of package '%s'", packageName)
+	}
+
+	if verifier != nil {
+		err = verifier.Verify(ctx, blobFilePath, file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "verifying blob of package '%s'", packageName)
+		}
+	}
+
+	if hook != nil {
+		infof("Running post_download hook of package '%s' on %s", packageName, blobFilePath)
+		blobFilePath, newBlob, err = hook.Run(ctx, blobFilePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "running post_download hook of package '%s'", packageName)
+		}
+	}
+	if blobFilePath == downloadPath {
+		downloadPath = ""
+	}
+	result.NewSha = newBlob.Sha
+	newBlob.Path = fmt.Sprintf("%s/%s", packageName, filepath.Base(blobFilePath))
+	newBlob.PackageName = packageName
+
+	// bootstrap files which do not have a blob yet
+	if len(blobs) == 0 {
+		infof("Adding blob: %s (%s)", newBlob.Path, newBlob.Sha)
+		return []blobChange{{FilePath: blobFilePath, DownloadPath: downloadPath, New: newBlob}}, nil
+	}
+
+	var changes []blobChange
+	for _, b := range outdated {
+		if newBlob.hasDigest(b.Sha) && !u.Options.Force {
+			infof("Unchanged blob: %s (%s)", b.Path, b.Sha)
+			continue
+		}
+
+		infof("Upgrading blob: %s (%s) --> %s (%s)", b.Path, b.Sha, newBlob.Path, newBlob.Sha)
+		changes = append(changes, blobChange{FilePath: blobFilePath, DownloadPath: downloadPath, Old: b, New: newBlob})
+		result.addOldSha(b.Sha)
+	}
+
+	return changes, nil
+}
+
+// checkMaxSize refuses files larger than -max-size by their declared size,
+// or by the Content-Length of a HEAD request if the metalink declares none.
+// The downloader enforces the limit on the transferred bytes as well.
+func (u *Upgrader) checkMaxSize(ctx context.Context, packageName string, file metalink.File) error {
+	maxSize := uint64(u.Options.MaxSize)
+	if maxSize == 0 {
+		return nil
+	}
+
+	size := file.Size
+	if size == 0 {
+		v, err := u.Downloader.Stat(ctx, file)
+		if err != nil {
+			debugf("Cannot determine the size of '%s': %v", file.Name, err)
+		}
+		size = uint64(v.ContentLength)
+	}
+
+	if size > maxSize {
+		return fmt.Errorf("metalink file '%s' of package '%s' has %s, which exceeds -max-size %s",
+			file.Name, packageName, formatBytes(int64(size)), formatBytes(int64(maxSize)))
+	}
+
+	return nil
+}
+
+// checkValidators requests the validators of the file and reports whether
+// they match the cached ones of its blob. The validators are recorded in the
+// result to be cached for the next run. Servers which do not support HEAD
+// requests or provide no validators fall back to a full download.
+func (u *Upgrader) checkValidators(ctx context.Context, packageName string, file metalink.File, blobs []*Blob, cached map[string]remoteValidators, result *packageResult) (bool, error) {
+	v, err := u.Downloader.Stat(ctx, file)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		debugf("Cannot check validators of '%s': %v", file.Name, err)
+		return false, nil
+	}
+	if v.empty() {
+		debugf("No validators provided for '%s'", file.Name)
+		return false, nil
+	}
+
+	if result.validators == nil {
+		result.validators = map[string]remoteValidators{}
+	}
+	result.validators[file.Name] = v
+
+	previous, ok := cached[file.Name]
+	if !ok || previous != v {
+		return false, nil
+	}
+
+	// the cached validators only describe a blob of the same name
+	blobPath := fmt.Sprintf("%s/%s", packageName, file.Name)
+	for _, b := range blobs {
+		if b.Path == blobPath {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// applyChanges adds the new blobs and removes the old ones. The changes of a
+// package are applied together: if one fails, blobs.yml is restored to its
+// state before the first change. With -cleanup-downloads, the added files are
+// removed afterwards.
+func (u *Upgrader) applyChanges(ctx context.Context, changes []blobChange) error {
+	// replaced blobs are only in the blobstore and cannot be added again by
+	// bosh, so the changes are undone by restoring blobs.yml
+	blobsPath := filepath.Join(u.configDir(), "blobs.yml")
+	var original []byte
+	if !u.Options.PrintCommands {
+		var err error
+		original, err = ioutil.ReadFile(blobsPath)
+		if err != nil {
+			return errors.Wrap(err, "reading blobs file")
+		}
+	}
+
+	err := u.applyBlobChanges(ctx, changes)
+	if err != nil {
+		if original == nil {
+			return err
+		}
+		restoreErr := writeFileAtomic(blobsPath, original, 0644)
+		if restoreErr != nil {
+			return errors.Wrapf(err, "restoring blobs.yml failed: %v", restoreErr)
+		}
+		warnf("restored blobs.yml after failing to apply the changes")
+		return err
+	}
+
+	// bosh keeps its own copy of added blobs, so the downloaded files are
+	// only removed once all of them were added, along with the downloads
+	// transformed by the post_download hook
+	if u.Options.CleanupDownloads && !u.Options.PrintCommands {
+		removed := map[string]bool{}
+		for _, c := range changes {
+			for _, path := range []string{c.FilePath, c.DownloadPath} {
+				if path == "" || removed[path] {
+					continue
+				}
+				removed[path] = true
+				debugf("Removing downloaded file %s", path)
+				err := os.Remove(path)
+				if err != nil && !os.IsNotExist(err) {
+					warnf("removing downloaded file: %v", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyBlobChanges runs the bosh commands of the changes and verifies the
+// result of each.
+func (u *Upgrader) applyBlobChanges(ctx context.Context, changes []blobChange) error {
+	for _, c := range changes {
+		// do not start replacing the blob if the run was cancelled already
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// add the new blob before removing the old one. Adding a blob with
+		// the same path replaces the old entry in place.
+		err := u.Bosh.AddBlob(ctx, c.FilePath, c.New.Path)
+		if err != nil {
+			return errors.Wrap(err, "adding new blobs")
+		}
+
+		// the file name changed with the version, so the old blob has to be
+		// removed explicitly
+		if c.Old != nil && c.New.Path != c.Old.Path {
+			infof("Removing renamed blob: %s", c.Old.Path)
+			err = u.Bosh.RemoveBlob(ctx, c.Old.Path)
+			if err != nil {
+				return errors.Wrap(err, "removing old blobs")
+			}
+		}
+
+		if u.Options.PrintCommands {
+			continue
+		}
+		err = verifyChange(u.configDir(), c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyChange re-reads blobs.yml after bosh modified it and checks that it
+// is still well-formed, contains the new blob of the change with its digest
+// and no longer contains a renamed old blob.
+func verifyChange(configDir string, c blobChange) error {
+	blobs, err := readBlobs(configDir)
+	if err != nil {
+		return errors.Wrap(err, "verifying blobs.yml")
+	}
+
+	newBlob, ok := blobs[c.New.Path]
+	if !ok {
+		return fmt.Errorf("verifying blobs.yml: new blob '%s' is missing", c.New.Path)
+	}
+	if !c.New.hasDigest(newBlob.Sha) {
+		return fmt.Errorf("verifying blobs.yml: new blob '%s' has digest '%s', expected '%s'", c.New.Path, newBlob.Sha, c.New.Sha)
+	}
+
+	if c.Old != nil && c.Old.Path != c.New.Path {
+		if _, ok := blobs[c.Old.Path]; ok {
+			return fmt.Errorf("verifying blobs.yml: old blob '%s' is still present", c.Old.Path)
+		}
+	}
+
+	return nil
+}
+
+// matchBlobs returns the blobs replaced by the metalink file. A blob matches
+// if its name equals the file name, optionally after replacing the old
+// version with the new version.
+func matchBlobs(file metalink.File, blobs []*Blob, oldVersion, newVersion string) []*Blob {
+	var matched []*Blob
+	for _, b := range blobs {
+		name := path.Base(b.Path)
+		if name == file.Name || (oldVersion != "" && strings.Replace(name, oldVersion, newVersion, -1) == file.Name) {
+			matched = append(matched, b)
+		}
+	}
+	return matched
+}
+
+// validateSource checks that the source has a version_check script unless the
+// version is pinned, exactly one way to get the metalink and a key for
+// signature verification.
+func validateSource(source Source) error {
+	if strings.TrimSpace(source.VersionCheck) == "" && source.Version == "" {
+		return errors.New("missing field 'source.version_check'")
+	}
+
+	var configured []string
+	for name, value := range map[string]string{
+		"source.metalink_get":  source.MetalinkGet,
+		"source.metalink_url":  source.MetalinkURL,
+		"source.metalink_file": source.MetalinkFile,
+	} {
+		if strings.TrimSpace(value) != "" {
+			configured = append(configured, name)
+		}
+	}
+	sort.Strings(configured)
+
+	if len(configured) == 0 {
+		return errors.New("missing field 'source.metalink_get' (or 'source.metalink_url' or 'source.metalink_file')")
+	}
+	if len(configured) > 1 {
+		return fmt.Errorf("only one of the fields '%s' may be set", strings.Join(configured, "', '"))
+	}
+
+	if source.MetalinkSha256 != "" && !sha256Pattern.MatchString(strings.TrimSpace(source.MetalinkSha256)) {
+		return fmt.Errorf("invalid field 'source.metalink_sha256' '%s' (expected 64 hex characters)", source.MetalinkSha256)
+	}
+
+	if source.SignatureURL != "" && source.SignatureKey == "" {
+		return errors.New("field 'source.signature_url' requires 'source.signature_key'")
+	}
+
+	return nil
+}
+
+// metalinkGetURL returns the URL if the metalink_get script is just an
+// http(s) URL, which is fetched instead of executed.
+func metalinkGetURL(script string) (string, bool) {
+	script = strings.TrimSpace(script)
+	if script == "" || strings.ContainsAny(script, " \t\r\n") {
+		return "", false
+	}
+	parsed, err := url.Parse(script)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", false
+	}
+	return script, true
+}
+
+// scriptEnv returns the variables of the scripts of the source run for the
+// version: the params, and the version and its tag, which always override
+// params of the same name.
+func scriptEnv(source Source, v *taggedVersion) map[string]string {
+	env := map[string]string{}
+	for name, value := range source.Params {
+		env[name] = value
+	}
+	env["version"] = v.Original()
+	env["version_tag"] = v.Tag
+	return env
+}
+
+// getMetalink returns the metalink of the version from the metalink_get
+// script, the metalink_url or the metalink_file of the source. The version is
+// expanded in the URL and file path. A metalink_get URL is fetched like a
+// metalink_url, with the params expanded as well.
+func (u *Upgrader) getMetalink(ctx context.Context, source Source, localBlobDir, packageName string, v *taggedVersion) ([]byte, error) {
+	if getURL, ok := metalinkGetURL(source.MetalinkGet); ok {
+		for name, value := range source.Params {
+			getURL = strings.Replace(getURL, "${"+name+"}", value, -1)
+		}
+		getURL = expandVersion(getURL, v)
+		meta4Bytes, err := u.Downloader.Get(ctx, getURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching metalink_get URL '%s' of package '%s'", getURL, packageName)
+		}
+		return meta4Bytes, nil
+	}
+
+	switch {
+	case source.MetalinkURL != "":
+		url := expandVersion(source.MetalinkURL, v)
+		meta4Bytes, err := u.Downloader.Get(ctx, url)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching metalink_url '%s' of package '%s'", url, packageName)
+		}
+		return meta4Bytes, nil
+	case source.MetalinkFile != "":
+		metalinkPath := expandVersion(source.MetalinkFile, v)
+		if !filepath.IsAbs(metalinkPath) {
+			metalinkPath = filepath.Join(localBlobDir, metalinkPath)
+		}
+		meta4Bytes, err := ioutil.ReadFile(metalinkPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading metalink_file of package '%s'", packageName)
+		}
+		return meta4Bytes, nil
+	default:
+		meta4Bytes, err := runScript(ctx, u.Options.ScriptTimeout, source.MetalinkGet, scriptEnv(source, v))
+		if err != nil {
+			return nil, errors.Wrapf(err, "executing metalink_get script of package '%s'", packageName)
+		}
+		return meta4Bytes, nil
+	}
+}
+
+// sha256Pattern matches a hex sha256 sum.
+var sha256Pattern = regexp.MustCompile(`^[0-9A-Fa-f]{64}$`)
+
+// verifyMetalinkDigest compares the sha256 sum of the metalink document with
+// the pinned metalink_sha256, if any, before the metalink is trusted for the
+// download URLs and hashes of the blobs.
+func verifyMetalinkDigest(meta4Bytes []byte, expected string) error {
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	if expected == "" {
+		return nil
+	}
+	actual := fmt.Sprintf("%x", sha256.Sum256(meta4Bytes))
+	if actual != expected {
+		return fmt.Errorf("sha256 mismatch: expected '%s' (metalink_sha256), got '%s'", expected, actual)
+	}
+	return nil
+}
+
+// getMetalinkFiles returns the selected files of the metalink of the version.
+func (u *Upgrader) getMetalinkFiles(ctx context.Context, source Source, localBlobDir, packageName string, v *taggedVersion) ([]metalink.File, error) {
+	meta4Bytes, err := u.getMetalink(ctx, source, localBlobDir, packageName, v)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyMetalinkDigest(meta4Bytes, source.MetalinkSha256)
+	if err != nil {
+		return nil, errors.Wrapf(err, "verifying metalink of package '%s' version '%s'", packageName, v.Original())
+	}
+	var meta4 metalink.Metalink
+	err = metalink.Unmarshal(meta4Bytes, &meta4)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling metalink of package '%s'", packageName)
+	}
+
+	if len(meta4.Files) == 0 {
+		return nil, fmt.Errorf("metalink of package '%s' version '%s' contains no files", packageName, v.Original())
+	}
+
+	files, err := selectFiles(meta4.Files, source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "selecting metalink files of package '%s'", packageName)
+	}
+
+	return files, nil
+}
+
+// getFiles returns the metalink files of the version. In offline mode, the
+// staged files replacing the blobs are used unless there is a metalink_file.
+func (u *Upgrader) getFiles(ctx context.Context, source Source, localBlobDir, packageName string, v *taggedVersion, blobs []*Blob, oldVersion string) ([]metalink.File, error) {
+	if u.Options.Offline && source.MetalinkFile == "" {
+		return offlineFiles(packageName, blobs, oldVersion, v)
+	}
+	return u.getMetalinkFiles(ctx, source, localBlobDir, packageName, v)
+}
+
+// prunePackage removes the blobs of the package which do not correspond to
+// any of the metalink files. Blobs already replaced by the changes are
+// skipped.
+func (u *Upgrader) prunePackage(ctx context.Context, packageName string, files []metalink.File, blobs []*Blob, changes []blobChange, result *packageResult) error {
+	current := map[string]bool{}
+	for _, file := range files {
+		current[fmt.Sprintf("%s/%s", packageName, file.Name)] = true
+	}
+	for _, c := range changes {
+		if c.Old != nil {
+			current[c.Old.Path] = true
+		}
+	}
+
+	for _, b := range blobs {
+		if current[b.Path] {
+			continue
+		}
+
+		infof("Pruning stale blob: %s (%s)", b.Path, b.Sha)
+		result.Pruned = append(result.Pruned, b.Path)
+		if u.Options.DryRun && !u.Options.PrintCommands {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := u.Bosh.RemoveBlob(ctx, b.Path)
+		if err != nil {
+			return errors.Wrapf(err, "pruning blob '%s'", b.Path)
+		}
+	}
+
+	return nil
+}
+
+// readResourceConfig reads and validates the resource file of the package.
+func readResourceConfig(resourcePath, packageName string) (ResourceConfig, error) {
+	var resourceConfig ResourceConfig
+
+	repositoryBytes, err := ioutil.ReadFile(resourcePath)
+	if err != nil {
+		return resourceConfig, errors.Wrapf(err, "reading resource file of package '%s'", packageName)
+	}
+
+	err = yaml.Unmarshal(repositoryBytes, &resourceConfig)
+	if err != nil {
+		return resourceConfig, errors.Wrapf(err, "decoding resource file of package '%s'", packageName)
+	}
+
+	err = resourceConfig.Source.expandEnv()
+	if err != nil {
+		return resourceConfig, errors.Wrapf(err, "expanding resource file '%s'", resourcePath)
+	}
+
+	err = validateSource(resourceConfig.Source)
+	if err != nil {
+		return resourceConfig, errors.Wrapf(err, "invalid resource file '%s'", resourcePath)
+	}
+
+	return resourceConfig, nil
+}
+
+// upgradePackage upgrades the blobs of the package described by the resource
+// file to the version selected before. The outcome is recorded in result.
+func (u *Upgrader) upgradePackage(ctx context.Context, resourcePath string, selection *versionSelection, blobs Blobs, result *packageResult) error {
+	opts := u.Options
+	localBlobDir := filepath.Dir(resourcePath)
+	packageName := result.Package
+
+	if selection.Err != nil {
+		return selection.Err
+	}
+	resourceConfig, latestVersion := selection.Config, selection.Version
+
+	versionPath := filepath.Join(localBlobDir, "version")
+
+	currentVersionBytes, err := ioutil.ReadFile(versionPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "reading version of package '%s'", packageName)
+	}
+
+	result.OldVersion = string(currentVersionBytes)
+	result.NewVersion = latestVersion.Original()
+
+	var packageBlobs []*Blob
+	for _, b := range blobs {
+		if b.PackageName == packageName {
+			packageBlobs = append(packageBlobs, b)
+		}
+	}
+
+	if result.OldVersion == result.NewVersion && !opts.Force {
+		if resourceConfig.Source.Version != "" {
+			result.Action = actionPinned
+			result.skip(skipPinned)
+		} else {
+			result.skip(skipVersionUnchanged)
+		}
+		if !opts.Prune || opts.Check {
+			return nil
+		}
+
+		files, err := u.getFiles(ctx, resourceConfig.Source, localBlobDir, packageName, latestVersion, packageBlobs, result.OldVersion)
+		if err != nil {
+			return err
+		}
+		return u.prunePackage(ctx, packageName, files, packageBlobs, nil, result)
+	}
+
+	// upstream may have deleted newer releases, which is not a reason to
+	// downgrade unless the version is pinned explicitly
+	if resourceConfig.Source.Version == "" && !opts.AllowDowngrade {
+		currentVersion, err := version.NewVersion(strings.TrimSpace(result.OldVersion))
+		if err == nil && latestVersion.LessThan(currentVersion) {
+			warnf("latest version '%s' of package '%s' is lower than the current version '%s' (use -allow-downgrade)",
+				result.NewVersion, packageName, result.OldVersion)
+			result.skip(skipDowngrade)
+			return nil
+		}
+	}
+
+	if opts.Check {
+		result.Action = actionOutdated
+		return nil
+	}
+
+	files, err := u.getFiles(ctx, resourceConfig.Source, localBlobDir, packageName, latestVersion, packageBlobs, result.OldVersion)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := newSignatureVerifier(resourceConfig.Source, localBlobDir, latestVersion, u.Downloader)
+	if err != nil {
+		return errors.Wrapf(err, "configuring signature verification of package '%s'", packageName)
+	}
+
+	hook := newPostDownloadHook(resourceConfig.Source, latestVersion, opts)
+
+	cached, err := readValidators(filepath.Join(localBlobDir, validatorsFileName))
+	if err != nil {
+		return errors.Wrapf(err, "reading validators of package '%s'", packageName)
+	}
+
+	// download and verify all files before modifying any blob, so that the
+	// blobs of the package are upgraded together or not at all
+	var changes []blobChange
+	for _, file := range files {
+		// with several files, only blobs of the same name are replaced
+		existingBlobs := packageBlobs
+		if len(files) > 1 {
+			existingBlobs = matchBlobs(file, packageBlobs, result.OldVersion, result.NewVersion)
+		}
+
+		fileChanges, err := u.planFile(ctx, verifier, hook, packageName, localBlobDir, file, existingBlobs, cached, result)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, fileChanges...)
+	}
+
+	if len(changes) > 0 {
+		result.Action = actionUpgraded
+	} else {
+		result.skip(skipBlobsUnchanged)
+	}
+
+	// the bosh commands only print themselves with -print-commands
+	if !opts.DryRun || opts.PrintCommands {
+		err = u.applyChanges(ctx, changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	// older downloads are only removed once the new blobs were added
+	if !opts.DryRun && opts.KeepDownloads > 0 && len(changes) > 0 {
+		err = pruneDownloads(localBlobDir, downloadedFiles(files, changes), latestVersion.Original(), opts.KeepDownloads)
+		if err != nil {
+			warnf("removing old downloads of package '%s': %v", packageName, err)
+		}
+	}
+
+	if opts.Prune {
+		err = u.prunePackage(ctx, packageName, files, packageBlobs, changes, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the version is written once the blobs were uploaded, so that a failed
+	// upload is retried by the next run
+	if !opts.DryRun {
+		result.versionFile = versionPath
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file next to the path and
+// renames it into place, so that the file is never left truncated.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	out, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%s.", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = out.Write(data)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpb587/metalink"
+	"gopkg.in/yaml.v2"
+)
+
+func TestReadResourceConfigMergeKeys(t *testing.T) {
+	resourcePath := filepath.Join(t.TempDir(), "resource.yml")
+	err := ioutil.WriteFile(resourcePath, []byte(`
+base: &base
+  version_check: echo 1.0.0
+  metalink_get: echo base
+  params: &params
+    os: linux
+    arch: amd64
+source:
+  <<: *base
+  metalink_get: echo override
+  params:
+    <<: *params
+    arch: arm64
+    variant: musl
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resourceConfig, err := readResourceConfig(resourcePath, "foo")
+	if err != nil {
+		t.Fatalf("readResourceConfig: %v", err)
+	}
+
+	source := resourceConfig.Source
+	if source.VersionCheck != "echo 1.0.0" {
+		t.Errorf("version_check = %q, want the merged %q", source.VersionCheck, "echo 1.0.0")
+	}
+	if source.MetalinkGet != "echo override" {
+		t.Errorf("metalink_get = %q, want the overriding %q", source.MetalinkGet, "echo override")
+	}
+	wantParams := map[string]string{"os": "linux", "arch": "arm64", "variant": "musl"}
+	if !reflect.DeepEqual(source.Params, wantParams) {
+		t.Errorf("params = %v, want %v", source.Params, wantParams)
+	}
+}
+
+// fakeDownloader serves metalinks and file contents from memory and records
+// the downloaded files.
+type fakeDownloader struct {
+	Metalinks  map[string]string
+	Contents   map[string]string
+	Validators remoteValidators
+	Downloads  []string
+}
+
+func (d *fakeDownloader) Download(ctx context.Context, filePath string, file metalink.File) (Blob, int64, error) {
+	content, ok := d.Contents[file.Name]
+	if !ok {
+		return Blob{}, 0, fmt.Errorf("no content of '%s'", file.Name)
+	}
+	d.Downloads = append(d.Downloads, file.Name)
+	err := ioutil.WriteFile(filePath, []byte(content), 0644)
+	if err != nil {
+		return Blob{}, 0, err
+	}
+
+	hashes, hashers := newDigestHashes()
+	for _, h := range hashers {
+		h.Write([]byte(content))
+	}
+	blob := Blob{digests: sumDigests(hashes)}
+	blob.Sha = formatDigest("sha256", blob.digests["sha256"])
+	return blob, int64(len(content)), nil
+}
+
+func (d *fakeDownloader) Get(ctx context.Context, url string) ([]byte, error) {
+	data, ok := d.Metalinks[url]
+	if !ok {
+		return nil, fmt.Errorf("unexpected request of '%s'", url)
+	}
+	return []byte(data), nil
+}
+
+func (d *fakeDownloader) Stat(ctx context.Context, file metalink.File) (remoteValidators, error) {
+	return d.Validators, nil
+}
+
+// fakeBosh modifies blobs.yml of the release like the bosh CLI and records
+// the commands. The command FailOn fails instead.
+type fakeBosh struct {
+	ConfigDir string
+	FailOn    string
+	Calls     []string
+}
+
+func (b *fakeBosh) modify(call string, fn func(blobs map[string]map[string]string) error) error {
+	b.Calls = append(b.Calls, call)
+	if strings.HasPrefix(call, b.FailOn+" ") {
+		return fmt.Errorf("%s failed", b.FailOn)
+	}
+
+	blobsPath := filepath.Join(b.ConfigDir, "blobs.yml")
+	data, err := ioutil.ReadFile(blobsPath)
+	if err != nil {
+		return err
+	}
+	blobs := map[string]map[string]string{}
+	err = yaml.Unmarshal(data, &blobs)
+	if err != nil {
+		return err
+	}
+	err = fn(blobs)
+	if err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(blobs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(blobsPath, data, 0644)
+}
+
+func (b *fakeBosh) AddBlob(ctx context.Context, filePath, blobPath string) error {
+	return b.modify("add-blob "+blobPath, func(blobs map[string]map[string]string) error {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		blobs[blobPath] = map[string]string{"size": fmt.Sprint(len(data)), "sha": fmt.Sprintf("sha256:%x", sha256.Sum256(data))}
+		return nil
+	})
+}
+
+func (b *fakeBosh) RemoveBlob(ctx context.Context, blobPath string) error {
+	return b.modify("remove-blob "+blobPath, func(blobs map[string]map[string]string) error {
+		delete(blobs, blobPath)
+		return nil
+	})
+}
+
+func (b *fakeBosh) UploadBlobs(ctx context.Context) error {
+	b.Calls = append(b.Calls, "upload-blobs")
+	return nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time {
+	return c.now
+}
+
+// testMetalink returns a metalink of the file with the sha256 hash of the
+// content.
+func testMetalink(name, content string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="%s">
+    <hash type="sha-256">%x</hash>
+    <size>%d</size>
+    <url>https://example.com/%s</url>
+  </file>
+</metalink>`, name, sha256.Sum256([]byte(content)), len(content), name)
+}
+
+func TestUpgradePackage(t *testing.T) {
+	const newContent = "foo 1.1.0"
+	newSha := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(newContent)))
+	oldBlobs := "foo/foo-1.0.0.tgz:\n  size: 9\n  object_id: abc\n  sha: sha256:0000\n"
+	metalinkURL := "https://example.com/foo-${version}.meta4"
+
+	tests := []struct {
+		name           string
+		blobs          string
+		currentVersion string
+		source         Source
+		opts           options
+		validators     map[string]remoteValidators
+		metalinkFile   string
+		failOn         string
+
+		wantErr        string
+		wantAction     string
+		wantSkip       string
+		wantDownloads  []string
+		wantCalls      []string
+		wantBlobs      []string
+		wantOldSha     string
+		wantVersioned  bool
+		wantValidators bool
+	}{
+		{
+			name:           "upgrades outdated blob",
+			blobs:          oldBlobs,
+			currentVersion: "1.0.0",
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantCalls:      []string{"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-1.0.0.tgz"},
+			wantBlobs:      []string{"foo/foo-1.1.0.tgz"},
+			wantOldSha:     "sha256:0000",
+			wantVersioned:  true,
+		},
+		{
+			name:          "adds blob of new package",
+			blobs:         "{}\n",
+			wantAction:    actionUpgraded,
+			wantDownloads: []string{"foo-1.1.0.tgz"},
+			wantCalls:     []string{"add-blob foo/foo-1.1.0.tgz"},
+			wantBlobs:     []string{"foo/foo-1.1.0.tgz"},
+			wantVersioned: true,
+		},
+		{
+			name:           "records the digests of all replaced blobs",
+			blobs:          oldBlobs + "foo/foo-extra-1.0.0.tgz:\n  size: 9\n  sha: sha256:1111\n",
+			currentVersion: "1.0.0",
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantCalls: []string{
+				"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-1.0.0.tgz",
+				"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-extra-1.0.0.tgz",
+			},
+			wantBlobs:     []string{"foo/foo-1.1.0.tgz"},
+			wantOldSha:    "sha256:0000,sha256:1111",
+			wantVersioned: true,
+		},
+		{
+			name:           "skips unchanged version",
+			blobs:          oldBlobs,
+			currentVersion: "1.1.0",
+			wantAction:     actionUnchanged,
+			wantSkip:       skipVersionUnchanged,
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+		},
+		{
+			name:           "skips unchanged pinned version",
+			blobs:          oldBlobs,
+			currentVersion: "1.1.0",
+			source:         Source{Version: "1.1.0"},
+			wantAction:     actionPinned,
+			wantSkip:       skipPinned,
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+		},
+		{
+			name:           "upgrades unchanged version with force",
+			blobs:          oldBlobs,
+			currentVersion: "1.1.0",
+			opts:           options{Force: true},
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantCalls:      []string{"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-1.0.0.tgz"},
+			wantBlobs:      []string{"foo/foo-1.1.0.tgz"},
+			wantOldSha:     "sha256:0000",
+			wantVersioned:  true,
+		},
+		{
+			name:           "skips downgrade",
+			blobs:          oldBlobs,
+			currentVersion: "2.0.0",
+			wantAction:     actionUnchanged,
+			wantSkip:       skipDowngrade,
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+		},
+		{
+			name:           "downgrades with allow-downgrade",
+			blobs:          oldBlobs,
+			currentVersion: "2.0.0",
+			opts:           options{AllowDowngrade: true},
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantCalls:      []string{"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-1.0.0.tgz"},
+			wantBlobs:      []string{"foo/foo-1.1.0.tgz"},
+			wantOldSha:     "sha256:0000",
+			wantVersioned:  true,
+		},
+		{
+			name:           "skips blob with unchanged digest",
+			blobs:          "foo/foo-1.0.0.tgz:\n  size: 9\n  sha: " + newSha + "\n",
+			currentVersion: "1.0.0",
+			wantAction:     actionUnchanged,
+			wantSkip:       skipBlobsUnchanged,
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+			wantVersioned:  true,
+		},
+		{
+			name:           "skips blob with unchanged validators",
+			blobs:          "foo/foo.tgz:\n  size: 9\n  sha: 0000000000000000000000000000000000000000\n",
+			currentVersion: "1.0.0",
+			metalinkFile:   "foo.tgz",
+			validators:     map[string]remoteValidators{"foo.tgz": {ETag: `"v1"`}},
+			wantAction:     actionUnchanged,
+			wantSkip:       skipBlobsUnchanged,
+			wantBlobs:      []string{"foo/foo.tgz"},
+			wantVersioned:  true,
+			wantValidators: true,
+		},
+		{
+			name:           "downloads blob with changed validators",
+			blobs:          "foo/foo.tgz:\n  size: 9\n  sha: 0000000000000000000000000000000000000000\n",
+			currentVersion: "1.0.0",
+			metalinkFile:   "foo.tgz",
+			validators:     map[string]remoteValidators{"foo.tgz": {ETag: `"v0"`}},
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo.tgz"},
+			wantCalls:      []string{"add-blob foo/foo.tgz"},
+			wantBlobs:      []string{"foo/foo.tgz"},
+			wantOldSha:     "0000000000000000000000000000000000000000",
+			wantVersioned:  true,
+			wantValidators: true,
+		},
+		{
+			name:           "check reports outdated package",
+			blobs:          oldBlobs,
+			currentVersion: "1.0.0",
+			opts:           options{Check: true},
+			wantAction:     actionOutdated,
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+		},
+		{
+			name:           "dry run downloads without modifying blobs",
+			blobs:          oldBlobs,
+			currentVersion: "1.0.0",
+			opts:           options{DryRun: true},
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+			wantOldSha:     "sha256:0000",
+		},
+		{
+			name:           "failing bosh restores blobs.yml",
+			blobs:          oldBlobs,
+			currentVersion: "1.0.0",
+			failOn:         "remove-blob",
+			wantErr:        "removing old blobs: remove-blob failed",
+			wantAction:     actionUpgraded,
+			wantDownloads:  []string{"foo-1.1.0.tgz"},
+			wantCalls:      []string{"add-blob foo/foo-1.1.0.tgz", "remove-blob foo/foo-1.0.0.tgz"},
+			wantBlobs:      []string{"foo/foo-1.0.0.tgz"},
+			wantOldSha:     "sha256:0000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			releaseDir := t.TempDir()
+			configDir := filepath.Join(releaseDir, "config")
+			packageDir := filepath.Join(configDir, "blobs", "foo")
+			if err := os.MkdirAll(packageDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(configDir, "blobs.yml"), []byte(tt.blobs), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.currentVersion != "" {
+				if err := ioutil.WriteFile(filepath.Join(packageDir, "version"), []byte(tt.currentVersion), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.validators != nil {
+				if err := writeValidators(filepath.Join(packageDir, validatorsFileName), tt.validators); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fileName := tt.metalinkFile
+			if fileName == "" {
+				fileName = "foo-1.1.0.tgz"
+			}
+			downloader := &fakeDownloader{
+				Metalinks:  map[string]string{"https://example.com/foo-1.1.0.meta4": testMetalink(fileName, newContent)},
+				Contents:   map[string]string{fileName: newContent},
+				Validators: remoteValidators{ETag: `"v1"`},
+			}
+			bosh := &fakeBosh{ConfigDir: configDir, FailOn: tt.failOn}
+
+			opts := tt.opts
+			opts.ConfigDir = "config"
+			opts.DigestAlgorithm = "sha256"
+			u := &Upgrader{ReleaseDir: releaseDir, Options: opts, Downloader: downloader, Bosh: bosh, Clock: fakeClock{}}
+
+			source := tt.source
+			source.MetalinkURL = metalinkURL
+			v, err := parseTaggedVersion("1.1.0", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			selection := &versionSelection{Config: ResourceConfig{Source: source}, Version: v}
+
+			blobs, err := readBlobs(configDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blobs.AssignPackages([]string{"foo"})
+
+			result := &packageResult{Package: "foo", Action: actionUnchanged}
+			err = u.upgradePackage(context.Background(), filepath.Join(packageDir, "resource.yml"), selection, blobs, result)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.Action != tt.wantAction {
+				t.Errorf("action = %q, want %q", result.Action, tt.wantAction)
+			}
+			if result.SkipReason != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", result.SkipReason, tt.wantSkip)
+			}
+			if !reflect.DeepEqual(downloader.Downloads, tt.wantDownloads) {
+				t.Errorf("downloads = %v, want %v", downloader.Downloads, tt.wantDownloads)
+			}
+			if !reflect.DeepEqual(bosh.Calls, tt.wantCalls) {
+				t.Errorf("bosh calls = %v, want %v", bosh.Calls, tt.wantCalls)
+			}
+			if result.OldSha != tt.wantOldSha {
+				t.Errorf("old sha = %q, want %q", result.OldSha, tt.wantOldSha)
+			}
+			if versioned := result.versionFile != ""; versioned != tt.wantVersioned {
+				t.Errorf("version file written = %v, want %v", versioned, tt.wantVersioned)
+			}
+			if hasValidators := len(result.validators) > 0; hasValidators != tt.wantValidators {
+				t.Errorf("validators recorded = %v, want %v", hasValidators, tt.wantValidators)
+			}
+
+			after, err := readBlobs(configDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for path := range after {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tt.wantBlobs) {
+				t.Errorf("blobs = %v, want %v", paths, tt.wantBlobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpb587/metalink"
+	"github.com/pkg/errors"
+)
+
+// Downloader downloads metalink files from their mirrors and small files like
+// metalinks. Stat returns the validators of a metalink file without
+// downloading it.
+type Downloader interface {
+	Download(ctx context.Context, filePath string, file metalink.File) (Blob, int64, error)
+	Get(ctx context.Context, url string) ([]byte, error)
+	Stat(ctx context.Context, file metalink.File) (remoteValidators, error)
+}
+
+// boshRunner runs the bosh commands modifying the blobs of the release.
+type boshRunner interface {
+	AddBlob(ctx context.Context, filePath, blobPath string) error
+	RemoveBlob(ctx context.Context, blobPath string) error
+	UploadBlobs(ctx context.Context) error
+}
+
+// clock returns the current time.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Upgrader upgrades the blobs of a release with its collaborators.
+type Upgrader struct {
+	ReleaseDir string
+	Options    options
+	Downloader Downloader
+	Bosh       boshRunner
+	Clock      clock
+}
+
+// NewUpgrader returns an Upgrader of the release using HTTP downloads, or the
+// staged files in offline mode, and the bosh CLI.
+func NewUpgrader(releaseDir string, opts options) (*Upgrader, error) {
+	var err error
+	var downloader Downloader = offlineDownloader{Digest: string(opts.DigestAlgorithm)}
+	if !opts.Offline {
+		downloader, err = newDownloader(opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring downloads")
+		}
+	}
+
+	// fail before downloading anything if the bosh binary is missing
+	bin := opts.BoshBin
+	if bin != "" {
+		bin, err = exec.LookPath(bin)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring bosh binary")
+		}
+	}
+
+	u := &Upgrader{
+		ReleaseDir: releaseDir,
+		Options:    opts,
+		Downloader: downloader,
+		Clock:      systemClock{},
+	}
+	u.Bosh = boshCLI{
+		ReleaseDir:    releaseDir,
+		ConfigDir:     u.configDir(),
+		Bin:           bin,
+		Verbose:       opts.Verbose,
+		PrintOnly:     opts.PrintCommands,
+		Digest:        string(opts.DigestAlgorithm),
+		PrivateConfig: opts.PrivateConfig,
+	}
+	return u, nil
+}
+
+// runReleases upgrades the releases in turn and returns a combined summary.
+// The remaining releases are upgraded if one fails, unless -fail-fast is set.
+func runReleases(ctx context.Context, releaseDirs []string, opts options) (*summary, error) {
+	if len(releaseDirs) == 1 {
+		u, err := NewUpgrader(releaseDirs[0], opts)
+		if err != nil {
+			return &summary{}, err
+		}
+		return u.Run(ctx)
+	}
+
+	report := &summary{}
+	var failures []string
+	for _, releaseDir := range releaseDirs {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		infof("Upgrading release '%s'", releaseDir)
+		u, err := NewUpgrader(releaseDir, opts)
+		if err != nil {
+			return report, err
+		}
+		releaseReport, err := u.Run(ctx)
+		for _, result := range releaseReport.Results {
+			result.Release = releaseDir
+		}
+		report.Results = append(report.Results, releaseReport.Results...)
+
+		if err != nil {
+			err = errors.Wrapf(err, "release '%s'", releaseDir)
+			if opts.FailFast || ctx.Err() != nil {
+				return report, err
+			}
+			warnf("continuing after failure: %v", err)
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return report, fmt.Errorf("%d of %d releases failed: %s", len(failures), len(releaseDirs), strings.Join(failures, "; "))
+	}
+
+	return report, nil
+}
+
+// configDir returns the directory containing blobs.yml and the resource
+// files.
+func (u *Upgrader) configDir() string {
+	if filepath.IsAbs(u.Options.ConfigDir) {
+		return u.Options.ConfigDir
+	}
+	return filepath.Join(u.ReleaseDir, u.Options.ConfigDir)
+}
+
+// checkConfigDir fails if the printed bosh commands would not use the config
+// directory: they run in the release directory, where bosh always uses
+// 'config'. A link to the config directory is the same directory.
+func (u *Upgrader) checkConfigDir() error {
+	same, err := sameConfigDir(u.ReleaseDir, u.configDir())
+	if err != nil {
+		return errors.Wrap(err, "checking config directory")
+	}
+	if same {
+		return nil
+	}
+
+	return fmt.Errorf("-print-commands requires -config-dir to be 'config' of the release, the bosh CLI has no option for the config directory")
+}
+
+// Run upgrades the blobs of the release and returns a summary of all checked
+// packages.
+func (u *Upgrader) Run(ctx context.Context) (*summary, error) {
+	report := &summary{}
+	releaseDir, opts := u.ReleaseDir, u.Options
+
+	os.Setenv("BOSH_NON_INTERACTIVE", "true")
+
+	// concurrent runs would race on blobs.yml, the version files and the
+	// blobstore
+	if !opts.Check {
+		unlock, err := acquireLock(releaseDir, opts.LockTimeout)
+		if err != nil {
+			return report, err
+		}
+		defer unlock()
+	}
+
+	// fail before modifying any blobs if the printed commands would modify
+	// other files or bosh could not upload them afterwards
+	if opts.PrintCommands {
+		err := u.checkConfigDir()
+		if err != nil {
+			return report, err
+		}
+	}
+	if !opts.DryRun && !opts.Check && !opts.SkipUpload {
+		err := checkBlobstoreCredentials(u.configDir(), opts.PrivateConfig)
+		if err != nil {
+			return report, err
+		}
+	}
+	if !opts.DryRun && !opts.Check && opts.GitHubPR {
+		_, err := githubConfigFromEnv()
+		if err != nil {
+			return report, errors.Wrap(err, "configuring pull requests")
+		}
+	}
+
+	blobs, err := readBlobs(u.configDir())
+	if err != nil {
+		return report, err
+	}
+
+	resourcePaths, err := findResourceFiles(u.configDir())
+	if err != nil {
+		return report, errors.Wrap(err, "finding resource files")
+	}
+
+	packageNames := make([]string, 0, len(resourcePaths))
+	for packageName := range resourcePaths {
+		packageNames = append(packageNames, packageName)
+	}
+	sort.Strings(packageNames)
+	blobs.AssignPackages(packageNames)
+
+	only := map[string]bool{}
+	for _, name := range opts.Only {
+		only[name] = false
+	}
+
+	var checkedNames []string
+	for _, packageName := range packageNames {
+		if len(only) > 0 {
+			if _, ok := only[packageName]; !ok {
+				result := report.add(packageName)
+				result.Action = actionSkipped
+				result.skip(skipNotSelected)
+				continue
+			}
+			only[packageName] = true
+		}
+		checkedNames = append(checkedNames, packageName)
+	}
+
+	// version_check scripts are network round-trips, so they run
+	// concurrently before the blobs are downloaded one package at a time
+	selections := u.selectVersions(ctx, checkedNames, resourcePaths, opts.CheckWorkers)
+
+	var failures []string
+	for _, packageName := range checkedNames {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		result := report.add(packageName)
+		err = u.upgradePackage(ctx, resourcePaths[packageName], selections[packageName], blobs, result)
+		if err != nil {
+			result.Action = actionFailed
+			result.Error = err.Error()
+			result.skip(skipFailed)
+			if opts.FailFast || ctx.Err() != nil {
+				return report, err
+			}
+			warnf("continuing after failure: %v", err)
+			failures = append(failures, err.Error())
+		}
+	}
+
+	for _, name := range opts.Only {
+		if !only[name] {
+			warnf("package '%s' has no resource.yml and was not checked.", name)
+		}
+	}
+
+	// the blobs of the other packages are still uploaded if packages failed
+	var failed error
+	if len(failures) > 0 {
+		failed = fmt.Errorf("%d of %d packages failed: %s", len(failures), report.checked(), strings.Join(failures, "; "))
+	}
+
+	if opts.Check {
+		return report, failed
+	}
+
+	if opts.DryRun {
+		if opts.PrintCommands && !opts.SkipUpload {
+			err = u.Bosh.UploadBlobs(ctx)
+			if err != nil {
+				return report, err
+			}
+		} else {
+			infof("Dry run: skipping upload of blobs.")
+		}
+		return report, failed
+	}
+
+	if opts.SkipUpload {
+		infof("Skipping upload of blobs.")
+	} else {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		err = u.Bosh.UploadBlobs(ctx)
+		if err != nil {
+			return report, errors.Wrap(err, "uploading blobs")
+		}
+	}
+
+	err = writeVersions(report)
+	if err != nil {
+		return report, err
+	}
+
+	if opts.Changelog != "" {
+		err = report.AppendChangelog(opts.Changelog, u.Clock.Now())
+		if err != nil {
+			return report, errors.Wrap(err, "appending changelog")
+		}
+	}
+
+	if opts.GitHubPR {
+		err = u.openPullRequest(ctx, report)
+		if err != nil {
+			return report, err
+		}
+	} else if opts.GitCommit {
+		err = u.commitChanges(ctx, report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, failed
+}
+
+// writeVersions writes the new version and the validators of the downloaded
+// files of each package whose blobs were added.
+func writeVersions(report *summary) error {
+	for _, result := range report.Results {
+		if result.versionFile == "" {
+			continue
+		}
+
+		err := writeFileAtomic(result.versionFile, []byte(result.NewVersion), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "writing version of package '%s'", result.Package)
+		}
+
+		if len(result.validators) == 0 {
+			continue
+		}
+		validatorsPath := filepath.Join(filepath.Dir(result.versionFile), validatorsFileName)
+		err = writeValidators(validatorsPath, result.validators)
+		if err != nil {
+			return errors.Wrapf(err, "writing validators of package '%s'", result.Package)
+		}
+	}
+
+	return nil
+}
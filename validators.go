@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// validatorsFileName is the file next to the version file of a package
+// which holds the validators of its last downloaded metalink files.
+const validatorsFileName = "validators.yml"
+
+// remoteValidators are the HTTP validators of a remote file, which tell
+// whether it changed without downloading it.
+type remoteValidators struct {
+	ETag          string `yaml:"etag,omitempty"`
+	LastModified  string `yaml:"last_modified,omitempty"`
+	ContentLength int64  `yaml:"content_length,omitempty"`
+}
+
+// empty reports whether the server provided no validators. The content
+// length alone is not a reliable validator.
+func (v remoteValidators) empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// readValidators returns the validators of the metalink files by name. A
+// missing file has no validators.
+func readValidators(path string) (map[string]remoteValidators, error) {
+	validators := map[string]remoteValidators{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return validators, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, &validators)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling '%s'", path)
+	}
+
+	return validators, nil
+}
+
+// writeValidators replaces the validators of the metalink files.
+func writeValidators(path string, validators map[string]remoteValidators) error {
+	data, err := yaml.Marshal(validators)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
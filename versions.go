@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// taggedVersion is a parsed version and the tag it was parsed from, which
+// may additionally carry the version_prefix.
+type taggedVersion struct {
+	*version.Version
+	Tag string
+}
+
+// parseTaggedVersion parses the tag after stripping the prefix.
+func parseTaggedVersion(tag, prefix string) (*taggedVersion, error) {
+	v, err := version.NewVersion(strings.TrimPrefix(tag, prefix))
+	if err != nil {
+		return nil, err
+	}
+	return &taggedVersion{Version: v, Tag: tag}, nil
+}
+
+// expandVersion replaces the placeholders ${version} and ${version_tag} with
+// the version and its tag.
+func expandVersion(s string, v *taggedVersion) string {
+	return strings.NewReplacer("${version}", v.Original(), "${version_tag}", v.Tag).Replace(s)
+}
+
+// selectVersion returns the pinned version of the source, or the latest
+// version reported by its version_check script.
+func selectVersion(ctx context.Context, source Source, packageName string, cache versionCache, opts options) (*taggedVersion, error) {
+	if source.Version != "" {
+		pinned, err := parseTaggedVersion(source.Version, source.VersionPrefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing pinned version '%s'", source.Version)
+		}
+		infof("Using pinned version '%s' of package '%s'.", pinned.Original(), packageName)
+		return pinned, nil
+	}
+
+	// the version_check script needs network access
+	if opts.Offline {
+		return nil, errors.New("-offline requires the version to be pinned with 'source.version'")
+	}
+
+	var err error
+	stdout, cached := cache.Get(packageName, source.VersionCheck)
+	if !cached {
+		stdout, err = runScript(ctx, opts.ScriptTimeout, source.VersionCheck, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "executing version_check script")
+		}
+
+		// an API which changed its shape often results in no output at
+		// all, which must not be cached
+		if strings.TrimSpace(string(stdout)) == "" {
+			return nil, errors.New("version_check script printed no versions")
+		}
+		cache.Put(packageName, source.VersionCheck, stdout)
+	}
+
+	var constraints version.Constraints
+	if source.VersionConstraint != "" {
+		constraints, err = version.NewConstraint(source.VersionConstraint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing version_constraint '%s'", source.VersionConstraint)
+		}
+	}
+
+	var include, exclude *regexp.Regexp
+	if source.VersionInclude != "" {
+		include, err = regexp.Compile(source.VersionInclude)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing version_include '%s'", source.VersionInclude)
+		}
+	}
+	if source.VersionExclude != "" {
+		exclude, err = regexp.Compile(source.VersionExclude)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing version_exclude '%s'", source.VersionExclude)
+		}
+	}
+
+	allowPrerelease := source.AllowPrerelease || opts.IncludePrerelease
+
+	var (
+		latestVersion *taggedVersion
+		parsed        int
+		prereleases   int
+		filtered      int
+		parseErrors   []string
+	)
+	for _, rawVersion := range strings.Split(strings.TrimSpace(string(stdout)), "\n") {
+		rawVersion = strings.TrimSpace(rawVersion)
+		if rawVersion == "" {
+			continue
+		}
+		if (include != nil && !include.MatchString(rawVersion)) || (exclude != nil && exclude.MatchString(rawVersion)) {
+			debugf("Ignoring version '%s' filtered by version_include or version_exclude", rawVersion)
+			filtered++
+			continue
+		}
+		v, err := parseTaggedVersion(rawVersion, source.VersionPrefix)
+		if err != nil {
+			warnf("ignoring unparseable version '%s' of package '%s': %v", rawVersion, packageName, err)
+			parseErrors = append(parseErrors, err.Error())
+			continue
+		}
+		parsed++
+		if v.Prerelease() != "" && !allowPrerelease {
+			prereleases++
+			continue
+		}
+		if constraints != nil && !constraints.Check(v.Version) {
+			continue
+		}
+		if latestVersion == nil || latestVersion.LessThan(v.Version) {
+			latestVersion = v
+		}
+	}
+
+	if parsed == 0 && len(parseErrors) == 0 && filtered > 0 {
+		return nil, errors.New("no version in version_check output matches version_include and version_exclude")
+	}
+
+	if parsed == 0 {
+		return nil, fmt.Errorf("no parseable version in version_check output: %s", strings.Join(parseErrors, "; "))
+	}
+
+	if latestVersion == nil && prereleases == parsed {
+		return nil, errors.New("no release version in version_check output (set allow_prerelease or use -include-prerelease to select pre-releases)")
+	}
+
+	if latestVersion == nil {
+		return nil, fmt.Errorf("no version matches version_constraint '%s'", source.VersionConstraint)
+	}
+
+	return latestVersion, nil
+}
+
+// versionSelection is the resource config and selected version of a package,
+// or the error of reading the config or selecting the version.
+type versionSelection struct {
+	Config  ResourceConfig
+	Version *taggedVersion
+	Err     error
+}
+
+// selectVersions reads the resource files of the packages and runs their
+// version_check scripts concurrently, at most workers at a time, before any
+// blob is downloaded.
+func (u *Upgrader) selectVersions(ctx context.Context, packageNames []string, resourcePaths map[string]string, workers int) map[string]*versionSelection {
+	if workers < 1 {
+		workers = 1
+	}
+	cache := newVersionCache(u.Options, u.Clock)
+
+	selections := make(map[string]*versionSelection, len(packageNames))
+	for _, packageName := range packageNames {
+		selections[packageName] = &versionSelection{}
+	}
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for packageName := range names {
+				s := selections[packageName]
+				s.Config, s.Err = readResourceConfig(resourcePaths[packageName], packageName)
+				if s.Err != nil {
+					continue
+				}
+				s.Version, s.Err = selectVersion(ctx, s.Config.Source, packageName, cache, u.Options)
+				if s.Err != nil {
+					s.Err = errors.Wrapf(s.Err, "selecting version of package '%s'", packageName)
+				}
+			}
+		}()
+	}
+
+	for _, packageName := range packageNames {
+		names <- packageName
+	}
+	close(names)
+	wg.Wait()
+
+	return selections
+}
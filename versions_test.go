@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelectVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  Source
+		opts    options
+		want    string
+		wantTag string
+		wantErr string
+	}{
+		{
+			name:   "latest version",
+			source: Source{VersionCheck: "printf '1.0.0\\n1.10.0\\n1.9.0\\n'"},
+			want:   "1.10.0",
+		},
+		{
+			name:    "version prefix",
+			source:  Source{VersionCheck: "printf 'release-1.0.0\\nrelease-1.1.0\\n'", VersionPrefix: "release-"},
+			want:    "1.1.0",
+			wantTag: "release-1.1.0",
+		},
+		{
+			name:   "unparseable lines are ignored",
+			source: Source{VersionCheck: "printf '1.0.0\\ngarbage\\n'"},
+			want:   "1.0.0",
+		},
+		{
+			name:    "pinned version",
+			source:  Source{VersionCheck: "exit 1", Version: "v1.2.3", VersionPrefix: "v"},
+			want:    "1.2.3",
+			wantTag: "v1.2.3",
+		},
+		{
+			name:    "invalid pinned version",
+			source:  Source{Version: "latest"},
+			wantErr: "parsing pinned version 'latest'",
+		},
+		{
+			name:   "pinned version in offline mode",
+			source: Source{Version: "1.2.3"},
+			opts:   options{Offline: true},
+			want:   "1.2.3",
+		},
+		{
+			name:    "unpinned version in offline mode",
+			source:  Source{VersionCheck: "echo 1.0.0"},
+			opts:    options{Offline: true},
+			wantErr: "-offline requires the version to be pinned",
+		},
+		{
+			name:   "version constraint",
+			source: Source{VersionCheck: "printf '1.4.0\\n1.4.7\\n1.5.0\\n2.0.0\\n'", VersionConstraint: "~> 1.4.0"},
+			want:   "1.4.7",
+		},
+		{
+			name:    "no version matches the constraint",
+			source:  Source{VersionCheck: "printf '1.0.0\\n2.0.0\\n'", VersionConstraint: ">= 3.0"},
+			wantErr: "no version matches version_constraint '>= 3.0'",
+		},
+		{
+			name:    "invalid version constraint",
+			source:  Source{VersionCheck: "echo 1.0.0", VersionConstraint: "~>"},
+			wantErr: "parsing version_constraint",
+		},
+		{
+			name:   "pre-releases are ignored",
+			source: Source{VersionCheck: "printf '1.0.0\\n2.0.0-rc1\\n'"},
+			want:   "1.0.0",
+		},
+		{
+			name:   "pre-releases allowed by the source",
+			source: Source{VersionCheck: "printf '1.0.0\\n2.0.0-rc1\\n'", AllowPrerelease: true},
+			want:   "2.0.0-rc1",
+		},
+		{
+			name:   "pre-releases included by option",
+			source: Source{VersionCheck: "printf '1.0.0\\n2.0.0-rc1\\n'"},
+			opts:   options{IncludePrerelease: true},
+			want:   "2.0.0-rc1",
+		},
+		{
+			name:    "only pre-releases",
+			source:  Source{VersionCheck: "printf '2.0.0-rc1\\n2.0.0-rc2\\n'"},
+			wantErr: "no release version in version_check output",
+		},
+		{
+			name:   "version include",
+			source: Source{VersionCheck: "printf '1.0.0\\n1.1.0\\n1.2.0-nightly\\n'", VersionInclude: `^\d+\.\d+\.\d+$`, AllowPrerelease: true},
+			want:   "1.1.0",
+		},
+		{
+			name:   "version exclude",
+			source: Source{VersionCheck: "printf '1.0.0\\n1.1.0\\n1.2.0-nightly\\n'", VersionExclude: "nightly", AllowPrerelease: true},
+			want:   "1.1.0",
+		},
+		{
+			name:    "all versions filtered",
+			source:  Source{VersionCheck: "printf '1.0.0-nightly\\n'", VersionExclude: "nightly"},
+			wantErr: "no version in version_check output matches version_include and version_exclude",
+		},
+		{
+			name:    "invalid version include",
+			source:  Source{VersionCheck: "echo 1.0.0", VersionInclude: "("},
+			wantErr: "parsing version_include",
+		},
+		{
+			name:    "empty output",
+			source:  Source{VersionCheck: "true"},
+			wantErr: "version_check script printed no versions",
+		},
+		{
+			name:    "blank output",
+			source:  Source{VersionCheck: "printf '  \\n\\n'"},
+			wantErr: "version_check script printed no versions",
+		},
+		{
+			name:    "no parseable version",
+			source:  Source{VersionCheck: "printf 'garbage\\n'"},
+			wantErr: "no parseable version in version_check output",
+		},
+		{
+			name:    "failing script",
+			source:  Source{VersionCheck: "exit 3"},
+			wantErr: "executing version_check script",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := selectVersion(context.Background(), tt.source, "foo", versionCache{}, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v.Original() != tt.want {
+				t.Errorf("version = %q, want %q", v.Original(), tt.want)
+			}
+			wantTag := tt.wantTag
+			if wantTag == "" {
+				wantTag = tt.want
+			}
+			if v.Tag != wantTag {
+				t.Errorf("tag = %q, want %q", v.Tag, wantTag)
+			}
+		})
+	}
+}